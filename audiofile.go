@@ -5,17 +5,67 @@ package mactts
 #cgo LDFLAGS: -framework AudioToolbox
 #include <AudioFile.h>
 #include <ExtendedAudioFile.h>
+#include <stdlib.h>
 
 extern OSStatus go_audiofile_readproc(void *data, SInt64 inPosition, UInt32 requestCount, void *buffer, UInt32 *actualCount);
 extern OSStatus go_audiofile_writeproc(void *data, SInt64 inPosition, UInt32 requestCount, void *buffer, UInt32 *actualCount);
 extern SInt64 go_audiofile_getsizeproc(void *data);
+
+// mactts_set_markers writes a marker list built from parallel arrays of marker fields to an audio file.
+static inline OSStatus mactts_set_markers(AudioFileID id, UInt32 n, CFStringRef *names, Float64 *frames, SInt32 *ids) {
+  UInt32 size = NumBytesNeededForMarkerList(n);
+  AudioFileMarkerList *list = calloc(1, size);
+  OSStatus stat;
+  UInt32 i;
+
+  if (list == NULL) {
+    return kAudioFileUnspecifiedError;
+  }
+  list->mNumberMarkers = n;
+  for (i = 0; i < n; i++) {
+    list->mMarkers[i].mFramePosition = frames[i];
+    list->mMarkers[i].mName = names[i];
+    list->mMarkers[i].mMarkerID = ids[i];
+    list->mMarkers[i].mType = kAudioFileMarkerType_Generic;
+  }
+  stat = AudioFileSetProperty(id, kAudioFilePropertyMarkerList, size, list);
+  free(list);
+  return stat;
+}
+
+// mactts_ext_read reads interleaved frames from an ExtAudioFile into a single buffer.
+static inline OSStatus mactts_ext_read(ExtAudioFileRef eaf, UInt32 channels, void *buf, UInt32 size, UInt32 *frames) {
+  AudioBufferList abl;
+  abl.mNumberBuffers = 1;
+  abl.mBuffers[0].mNumberChannels = channels;
+  abl.mBuffers[0].mDataByteSize = size;
+  abl.mBuffers[0].mData = buf;
+  return ExtAudioFileRead(eaf, frames, &abl);
+}
+
+// mactts_ext_write writes interleaved frames from a single buffer to an ExtAudioFile.
+static inline OSStatus mactts_ext_write(ExtAudioFileRef eaf, UInt32 channels, void *buf, UInt32 size, UInt32 frames) {
+  AudioBufferList abl;
+  abl.mNumberBuffers = 1;
+  abl.mBuffers[0].mNumberChannels = channels;
+  abl.mBuffers[0].mDataByteSize = size;
+  abl.mBuffers[0].mData = buf;
+  return ExtAudioFileWrite(eaf, frames, &abl);
+}
 */
 import "C"
+import "errors"
 import "fmt"
 import "unsafe"
 import "io"
+import "math"
+import "os"
 import "reflect"
 import "runtime"
+import "sort"
+import "sync/atomic"
+import "time"
+import "encoding/binary"
 
 //export go_audiofile_getsizeproc
 func go_audiofile_getsizeproc(data unsafe.Pointer) C.SInt64 {
@@ -33,11 +83,22 @@ func go_audiofile_readproc(data unsafe.Pointer, inPosition C.SInt64, requestCoun
 		Cap:  length,
 	}
 	bslice := *(*[]byte)(unsafe.Pointer(&hdr))
-	n, err := af.target.ReadAt(bslice, int64(inPosition))
+	pos := int64(inPosition)
+
+	// Only a read starting at or beyond the end of the file is an EOF. CoreAudio reads back regions of the file while
+	// finalizing it, and a short read within the data written so far must succeed.
+	if pos >= af.fileSize {
+		*actualCount = 0
+		return C.kAudioFileEndOfFileError
+	}
+	if pos+int64(length) > af.fileSize {
+		bslice = bslice[:af.fileSize-pos]
+	}
+	n, err := af.target.ReadAt(bslice, pos)
 	*actualCount = C.UInt32(n)
-	if err == io.EOF {
+	if err == io.EOF && n == 0 {
 		return C.kAudioFileEndOfFileError
-	} else if err != nil {
+	} else if err != nil && err != io.EOF {
 		return C.kAudioFileUnspecifiedError
 	}
 	return C.OSStatus(0)
@@ -55,6 +116,16 @@ func go_audiofile_writeproc(data unsafe.Pointer, inPosition C.SInt64, requestCou
 	bslice := *(*[]byte)(unsafe.Pointer(&hdr))
 	npos := int64(inPosition)
 
+	// gain is only applied to whole samples in the audio data, never to the file header
+	if af.gain != 1 && npos >= af.dataOffset && (npos-af.dataOffset)%2 == 0 && length%2 == 0 {
+		bslice = scaleSamples(bslice, af.gain, af.byteOrder())
+	}
+
+	// the header written when the file is created is not audio
+	if af.opened && af.firstWrite == 0 && npos >= af.dataOffset {
+		af.firstWrite = time.Now().UnixNano()
+	}
+
 	n, err := af.target.WriteAt(bslice, npos)
 	*actualCount = C.UInt32(n)
 	if err != nil {
@@ -78,22 +149,131 @@ func osStatus(stat C.OSStatus) error {
 	return fmt.Errorf("OSStatus: %v", osStatToString(stat))
 }
 
+// scaleSamples returns a copy of the 16-bit linear PCM samples in p multiplied by gain and clipped to the sample range.
+func scaleSamples(p []byte, gain float64, order binary.ByteOrder) []byte {
+	out := make([]byte, len(p))
+	for i := 0; i+1 < len(p); i += 2 {
+		v := float64(int16(order.Uint16(p[i:]))) * gain
+		if v > math.MaxInt16 {
+			v = math.MaxInt16
+		} else if v < math.MinInt16 {
+			v = math.MinInt16
+		}
+		order.PutUint16(out[i:], uint16(int16(v)))
+	}
+	return out
+}
+
 // ReadWriterAt is a composed interface of a standard io.ReaderAt and io.WriterAt.
 type ReadWriterAt interface {
 	io.ReaderAt
 	io.WriterAt
 }
 
+// memFile is an in-memory ReadWriterAt. Like a file, it returns io.EOF with a short read at its end.
+type memFile struct {
+	b []byte
+}
+
+func (m *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(m.b)) {
+		m.b = append(m.b, make([]byte, end-int64(len(m.b)))...)
+	}
+	return copy(m.b[off:], p), nil
+}
+
+var errReadOnly = errors.New("audio file is open for reading only")
+
+// readOnlyTarget adapts an io.ReaderAt to be the target of an input file.
+type readOnlyTarget struct {
+	io.ReaderAt
+}
+
+func (readOnlyTarget) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errReadOnly
+}
+
+// readerSize determines the size of r, which must either have a Size method or be a file.
+func readerSize(r io.ReaderAt) (int64, error) {
+	switch r := r.(type) {
+	case interface {
+		Size() int64
+	}:
+		return r.Size(), nil
+	case interface {
+		Stat() (os.FileInfo, error)
+	}:
+		fi, err := r.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	return 0, errors.New("cannot determine the size of the audio source")
+}
+
+// AudioFileType identifies the container format of an audio file.
+type AudioFileType C.AudioFileTypeID
+
+const (
+	AudioFileWAVE AudioFileType = C.kAudioFileWAVEType
+	AudioFileAIFF AudioFileType = C.kAudioFileAIFFType
+	AudioFileCAF  AudioFileType = C.kAudioFileCAFType
+	AudioFileM4A  AudioFileType = C.kAudioFileM4AType
+	// AudioFileMP3 files can be opened for input, but not for output.
+	AudioFileMP3 AudioFileType = C.kAudioFileMP3Type
+)
+
 // AudioFile wraps a CoreAudio AudioFile handle and allows handling file operations within Go.
 type AudioFile struct {
-	id       C.AudioFileID
-	target   ReadWriterAt
-	fileSize int64
+	id         C.AudioFileID
+	target     ReadWriterAt
+	input      bool
+	fileSize   int64
+	format     C.AudioStreamBasicDescription
+	dataOffset int64
+	gain       float64
+	opened     bool
+	firstWrite int64 // in Unix nanoseconds
+}
+
+func finalizeAudioFile(af *AudioFile) {
+	if af.id != nil {
+		leaked("AudioFile", &liveAudioFiles)
+		C.AudioFileClose(af.id)
+	}
+}
+
+// byteOrder returns the byte order of the samples in a linear PCM file.
+func (af *AudioFile) byteOrder() binary.ByteOrder {
+	if af.format.mFormatFlags&C.kAudioFormatFlagIsBigEndian != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
 }
 
+var errMP3Output = errors.New("MP3 output is not supported: CoreAudio can decode MP3 but has no MP3 encoder")
+
 func newOutputFile(target ReadWriterAt, asbd *C.AudioStreamBasicDescription, fileType C.AudioFileTypeID) (*AudioFile, error) {
+	if fileType == C.kAudioFileMP3Type || asbd.mFormatID == C.kAudioFormatMPEGLayer3 {
+		return nil, errMP3Output
+	}
 	af := AudioFile{
-		target: target,
+		target:     target,
+		format:     *asbd,
+		dataOffset: math.MaxInt64,
+		gain:       1,
 	}
 
 	stat := C.AudioFileInitializeWithCallbacks(unsafe.Pointer(&af), (*[0]byte)(C.go_audiofile_readproc), (*[0]byte)(C.go_audiofile_writeproc),
@@ -101,59 +281,311 @@ func newOutputFile(target ReadWriterAt, asbd *C.AudioStreamBasicDescription, fil
 	if stat != 0 {
 		return nil, osStatus(stat)
 	}
-	runtime.SetFinalizer(&af, func(af *AudioFile) {
-		if af.id != nil {
-			C.AudioFileClose(af.id)
-		}
-	})
+	var ofs C.SInt64
+	size := C.UInt32(unsafe.Sizeof(ofs))
+	if C.AudioFileGetProperty(af.id, C.kAudioFilePropertyDataOffset, &size, unsafe.Pointer(&ofs)) == 0 {
+		af.dataOffset = int64(ofs)
+	}
+	af.opened = true
+	atomic.AddInt64(&liveAudioFiles, 1)
+	runtime.SetFinalizer(&af, finalizeAudioFile)
 	return &af, nil
 }
 
-// NewOutputWAVEFile opens a CoreAudio WAVE file suitable for output to target.
+// OpenInputFile opens the audio file of the given size read from source, for decoding with ExtAudioFile.
+func OpenInputFile(source io.ReaderAt, size int64) (*AudioFile, error) {
+	af := AudioFile{
+		target:     readOnlyTarget{source},
+		input:      true,
+		fileSize:   size,
+		dataOffset: math.MaxInt64,
+		gain:       1,
+	}
+
+	stat := C.AudioFileOpenWithCallbacks(unsafe.Pointer(&af), (*[0]byte)(C.go_audiofile_readproc), nil,
+		(*[0]byte)(C.go_audiofile_getsizeproc), nil, 0, &af.id)
+	if stat != 0 {
+		return nil, osStatus(stat)
+	}
+	atomic.AddInt64(&liveAudioFiles, 1)
+	runtime.SetFinalizer(&af, finalizeAudioFile)
+	fsize := C.UInt32(unsafe.Sizeof(af.format))
+	if stat = C.AudioFileGetProperty(af.id, C.kAudioFilePropertyDataFormat, &fsize, unsafe.Pointer(&af.format)); stat != 0 {
+		af.Close()
+		return nil, osStatus(stat)
+	}
+	return &af, nil
+}
+
+// StreamFormat describes the format of the audio data in a file. It mirrors the CoreAudio AudioStreamBasicDescription.
 //
-// rate is the sample rate, numchan is the number of channels in the output, and numbits is the number of bits per channel.
-// NOTE: In order to prevent unnecessary copying, the calls to target use buffers that are owned by CoreAudio. This means that
-// slices should not be made of buffers that will outlive the call to the WriteAt method.
-func NewOutputWAVEFile(target ReadWriterAt, rate float64, numchan int, numbits int) (*AudioFile, error) {
+// For formats with a variable number of bytes or frames per packet, such as AAC, the respective fields are zero.
+//
+// A StreamFormat can describe formats the output file constructors do not choose, for use with
+// NewOutputFileWithFormat. For example, 8 kHz mono a-law audio in a WAVE file is
+//
+//	StreamFormat{SampleRate: 8000, FormatID: FormatALaw, BytesPerPacket: 1, FramesPerPacket: 1,
+//		BytesPerFrame: 1, ChannelsPerFrame: 1, BitsPerChannel: 8}
+type StreamFormat struct {
+	SampleRate       float64
+	FormatID         uint32
+	FormatFlags      uint32
+	BytesPerPacket   uint32
+	FramesPerPacket  uint32
+	BytesPerFrame    uint32
+	ChannelsPerFrame uint32
+	BitsPerChannel   uint32
+}
+
+// Audio data format identifiers for StreamFormat.FormatID.
+const (
+	FormatLinearPCM     = C.kAudioFormatLinearPCM
+	FormatMPEG4AAC      = C.kAudioFormatMPEG4AAC
+	FormatAppleLossless = C.kAudioFormatAppleLossless
+	FormatULaw          = C.kAudioFormatULaw
+	FormatALaw          = C.kAudioFormatALaw
+)
+
+// Linear PCM format flags for StreamFormat.FormatFlags.
+const (
+	FormatFlagIsFloat          = C.kAudioFormatFlagIsFloat
+	FormatFlagIsBigEndian      = C.kAudioFormatFlagIsBigEndian
+	FormatFlagIsSignedInteger  = C.kAudioFormatFlagIsSignedInteger
+	FormatFlagIsPacked         = C.kAudioFormatFlagIsPacked
+	FormatFlagIsNonInterleaved = C.kAudioFormatFlagIsNonInterleaved
+)
+
+func (f *StreamFormat) asbd() C.AudioStreamBasicDescription {
+	return C.AudioStreamBasicDescription{
+		mSampleRate:       C.Float64(f.SampleRate),
+		mFormatID:         C.AudioFormatID(f.FormatID),
+		mFormatFlags:      C.AudioFormatFlags(f.FormatFlags),
+		mBytesPerPacket:   C.UInt32(f.BytesPerPacket),
+		mFramesPerPacket:  C.UInt32(f.FramesPerPacket),
+		mBytesPerFrame:    C.UInt32(f.BytesPerFrame),
+		mChannelsPerFrame: C.UInt32(f.ChannelsPerFrame),
+		mBitsPerChannel:   C.UInt32(f.BitsPerChannel),
+	}
+}
+
+func streamFormat(asbd *C.AudioStreamBasicDescription) StreamFormat {
+	return StreamFormat{
+		SampleRate:       float64(asbd.mSampleRate),
+		FormatID:         uint32(asbd.mFormatID),
+		FormatFlags:      uint32(asbd.mFormatFlags),
+		BytesPerPacket:   uint32(asbd.mBytesPerPacket),
+		FramesPerPacket:  uint32(asbd.mFramesPerPacket),
+		BytesPerFrame:    uint32(asbd.mBytesPerFrame),
+		ChannelsPerFrame: uint32(asbd.mChannelsPerFrame),
+		BitsPerChannel:   uint32(asbd.mBitsPerChannel),
+	}
+}
+
+// linearPCMFormat describes packed signed integer linear PCM audio.
+func linearPCMFormat(rate float64, numchan int, numbits int, bigEndian bool) C.AudioStreamBasicDescription {
 	bpf := C.UInt32(numbits * numchan / 8)
-	asbd := C.AudioStreamBasicDescription{
+	flags := C.AudioFormatFlags(C.kAudioFormatFlagIsSignedInteger | C.kAudioFormatFlagIsPacked)
+	if bigEndian {
+		flags |= C.kAudioFormatFlagIsBigEndian
+	}
+	return C.AudioStreamBasicDescription{
 		mSampleRate:       C.Float64(rate),
 		mFormatID:         C.kAudioFormatLinearPCM,
-		mFormatFlags:      C.kAudioFormatFlagIsSignedInteger | C.kAudioFormatFlagIsPacked,
+		mFormatFlags:      flags,
 		mBytesPerPacket:   bpf,
 		mFramesPerPacket:  1,
 		mBytesPerFrame:    bpf,
 		mChannelsPerFrame: C.UInt32(numchan),
 		mBitsPerChannel:   C.UInt32(numbits),
 	}
-	return newOutputFile(target, &asbd, C.kAudioFileWAVEType)
 }
 
-// NewOutputAACFile opens a CoreAudio MP4 encapsulated AAC file suitable for output to target.
-//
-// rate is the sample rate, numchan is the number of channels in the output, and numbits is the number of bits per channel.
-// NOTE: In order to prevent unnecessary copying, the calls to target use buffers that are owned by CoreAudio. This means that
-// slices should not be made of buffers that will outlive the call to the WriteAt method.
-func NewOutputAACFile(target ReadWriterAt, rate float64, numchan int, numbits int) (*AudioFile, error) {
-	asbd := C.AudioStreamBasicDescription{
+// FloatPCMFormat describes little endian 32-bit floating point linear PCM audio, for output with
+// NewOutputFileWithFormat to a WAVE or CAF file. Float samples leave headroom for later processing, such as
+// normalization, without loss.
+func FloatPCMFormat(rate float64, numchan int) StreamFormat {
+	bpf := uint32(4 * numchan)
+	return StreamFormat{
+		SampleRate:       rate,
+		FormatID:         FormatLinearPCM,
+		FormatFlags:      FormatFlagIsFloat | FormatFlagIsPacked,
+		BytesPerPacket:   bpf,
+		FramesPerPacket:  1,
+		BytesPerFrame:    bpf,
+		ChannelsPerFrame: uint32(numchan),
+		BitsPerChannel:   32,
+	}
+}
+
+// aacFormat describes AAC encoded audio.
+func aacFormat(rate float64, numchan int) C.AudioStreamBasicDescription {
+	return C.AudioStreamBasicDescription{
 		mSampleRate:       C.Float64(rate),
 		mFormatID:         C.kAudioFormatMPEG4AAC,
 		mFormatFlags:      C.kMPEG4Object_AAC_Main,
 		mChannelsPerFrame: C.UInt32(numchan),
 		mFramesPerPacket:  1024,
 	}
-	return newOutputFile(target, &asbd, C.kAudioFileM4AType)
+}
+
+// newOutputFileType opens an output file of type t with a data format suited to the file type. Linear PCM formats
+// use numbits bits per channel.
+func newOutputFileType(target ReadWriterAt, t AudioFileType, rate float64, numchan int, numbits int) (*AudioFile, error) {
+	var asbd C.AudioStreamBasicDescription
+	switch t {
+	case AudioFileWAVE, AudioFileCAF:
+		asbd = linearPCMFormat(rate, numchan, numbits, false)
+	case AudioFileAIFF:
+		asbd = linearPCMFormat(rate, numchan, numbits, true)
+	case AudioFileM4A:
+		asbd = aacFormat(rate, numchan)
+	case AudioFileMP3:
+		return nil, errMP3Output
+	default:
+		return nil, fmt.Errorf("unsupported audio file type: %v", osStatToString(C.OSStatus(t)))
+	}
+	return newOutputFile(target, &asbd, C.AudioFileTypeID(t))
+}
+
+// NewOutputFileWithFormat opens a CoreAudio file of type t suitable for output to target, storing audio data in the
+// given format. Not every format can be stored in every type of file. The constructors for each file type, such as
+// NewOutputWAVEFile, choose a suitable format themselves.
+//
+// NOTE: In order to prevent unnecessary copying, the calls to target use buffers that are owned by CoreAudio. This means that
+// slices should not be made of buffers that will outlive the call to the WriteAt method.
+func NewOutputFileWithFormat(target ReadWriterAt, t AudioFileType, format StreamFormat) (*AudioFile, error) {
+	asbd := format.asbd()
+	return newOutputFile(target, &asbd, C.AudioFileTypeID(t))
+}
+
+// NewOutputWAVEFile opens a CoreAudio WAVE file suitable for output to target.
+//
+// rate is the sample rate, numchan is the number of channels in the output, and numbits is the number of bits per channel.
+// NOTE: In order to prevent unnecessary copying, the calls to target use buffers that are owned by CoreAudio. This means that
+// slices should not be made of buffers that will outlive the call to the WriteAt method.
+func NewOutputWAVEFile(target ReadWriterAt, rate float64, numchan int, numbits int) (*AudioFile, error) {
+	return newOutputFileType(target, AudioFileWAVE, rate, numchan, numbits)
+}
+
+// NewOutputAIFFFile opens a CoreAudio AIFF file suitable for output to target. The audio is stored as big endian
+// linear PCM, as AIFF requires.
+//
+// rate is the sample rate, numchan is the number of channels in the output, and numbits is the number of bits per channel.
+// NOTE: In order to prevent unnecessary copying, the calls to target use buffers that are owned by CoreAudio. This means that
+// slices should not be made of buffers that will outlive the call to the WriteAt method.
+func NewOutputAIFFFile(target ReadWriterAt, rate float64, numchan int, numbits int) (*AudioFile, error) {
+	return newOutputFileType(target, AudioFileAIFF, rate, numchan, numbits)
+}
+
+// NewOutputCAFFile opens a CoreAudio CAF file suitable for output to target. Unlike WAVE and AIFF files, CAF files
+// have no 4 GB size limit.
+//
+// rate is the sample rate, numchan is the number of channels in the output, and numbits is the number of bits per channel.
+// NOTE: In order to prevent unnecessary copying, the calls to target use buffers that are owned by CoreAudio. This means that
+// slices should not be made of buffers that will outlive the call to the WriteAt method.
+func NewOutputCAFFile(target ReadWriterAt, rate float64, numchan int, numbits int) (*AudioFile, error) {
+	return newOutputFileType(target, AudioFileCAF, rate, numchan, numbits)
+}
+
+// NewOutputAACFile opens a CoreAudio MP4 encapsulated AAC file suitable for output to target.
+//
+// rate is the sample rate and numchan is the number of channels in the output. numbits is ignored, as AAC audio has no
+// fixed number of bits per sample; it is accepted so that NewOutputAACFile can be used in place of NewOutputWAVEFile.
+// NOTE: In order to prevent unnecessary copying, the calls to target use buffers that are owned by CoreAudio. This means that
+// slices should not be made of buffers that will outlive the call to the WriteAt method.
+func NewOutputAACFile(target ReadWriterAt, rate float64, numchan int, numbits int) (*AudioFile, error) {
+	return newOutputFileType(target, AudioFileM4A, rate, numchan, numbits)
+}
+
+// Format returns the format of the audio data stored in the file.
+func (af *AudioFile) Format() StreamFormat {
+	return streamFormat(&af.format)
+}
+
+// Size returns the size in bytes of the file: the extent of the data written to an output file, or the size given when
+// an input file was opened. Once the file and its ExtAudioFile are closed, the size of an output file is final and
+// can be used as its Content-Length.
+func (af *AudioFile) Size() int64 {
+	return af.fileSize
+}
+
+var errNoDuration = errors.New("duration of the audio format cannot be determined")
+
+// Duration returns the duration of the audio in the file, from the number of packets of audio data and the frames per
+// packet and sample rate of its format. For an output file it includes the audio written so far, and for an AAC file
+// the frames the encoder adds at the start and end of the audio. Duration must be called before the file is closed.
+func (af *AudioFile) Duration() (time.Duration, error) {
+	if af.format.mFramesPerPacket == 0 || af.format.mSampleRate == 0 {
+		return 0, errNoDuration
+	}
+	var packets C.UInt64
+	size := C.UInt32(unsafe.Sizeof(packets))
+	if stat := C.AudioFileGetProperty(af.id, C.kAudioFilePropertyAudioDataPacketCount, &size, unsafe.Pointer(&packets)); stat != 0 {
+		return 0, osStatus(stat)
+	}
+	frames := float64(packets) * float64(af.format.mFramesPerPacket)
+	return time.Duration(frames / float64(af.format.mSampleRate) * float64(time.Second)), nil
+}
+
+// FirstWriteTime returns the time at which audio data was first written to an output file, after its header was
+// written when the file was opened. The zero time is returned if no audio has been written.
+//
+// When synthesizing to the file, the time from starting to speak to the first write is the latency of the synthesizer
+// in producing audio.
+func (af *AudioFile) FirstWriteTime() time.Time {
+	if af.firstWrite == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, af.firstWrite)
+}
+
+// Marker labels a sample frame position in an audio file.
+type Marker struct {
+	ID    int32
+	Name  string
+	Frame int64
+}
+
+// SetMarkers stores a list of markers in the audio file, replacing any already present. In WAVE files the markers are
+// written as cue points, which audio editors import as labeled positions.
+//
+// Channel.SpeakMarkers sets markers at the embedded sync commands of the text it speaks. SetMarkers must be called
+// before the file is closed.
+func (af *AudioFile) SetMarkers(markers []Marker) error {
+	n := len(markers)
+	if n == 0 {
+		return osStatus(C.mactts_set_markers(af.id, 0, nil, nil, nil))
+	}
+	names := make([]C.CFStringRef, n)
+	frames := make([]C.Float64, n)
+	ids := make([]C.SInt32, n)
+	for i, m := range markers {
+		names[i] = cfstring(m.Name)
+		frames[i] = C.Float64(m.Frame)
+		ids[i] = C.SInt32(m.ID)
+	}
+	stat := C.mactts_set_markers(af.id, C.UInt32(n), &names[0], &frames[0], &ids[0])
+	for _, name := range names {
+		C.CFRelease(C.CFTypeRef(name))
+	}
+	return osStatus(stat)
 }
 
 // ExtAudioFile returns a ExtAudioFile that wraps the CoreAudio AudioFile
 func (af *AudioFile) ExtAudioFile() (*ExtAudioFile, error) {
 	var eaf = ExtAudioFile{af: af}
-	stat := C.ExtAudioFileWrapAudioFileID(af.id, 1, &eaf.ceaf)
+	var forWriting C.Boolean = 1
+	if af.input {
+		forWriting = 0
+	}
+	stat := C.ExtAudioFileWrapAudioFileID(af.id, forWriting, &eaf.ceaf)
 	if stat != 0 {
 		return nil, osStatus(stat)
 	}
+	atomic.AddInt64(&liveExtAudioFiles, 1)
 	runtime.SetFinalizer(&eaf, func(eaf *ExtAudioFile) {
 		if eaf.ceaf != nil {
+			leaked("ExtAudioFile", &liveExtAudioFiles)
 			C.ExtAudioFileDispose(eaf.ceaf)
 		}
 	})
@@ -167,6 +599,9 @@ func (af *AudioFile) Close() error {
 	if af.id == nil {
 		return nil
 	}
+	atomic.AddInt64(&liveAudioFiles, -1)
+	// chunks written after the audio data on close must not be scaled
+	af.gain = 1
 	stat := C.AudioFileClose(af.id)
 	af.id = nil
 	runtime.SetFinalizer(af, nil)
@@ -179,6 +614,286 @@ type ExtAudioFile struct {
 	af   *AudioFile
 }
 
+// Encoder quality values for SetEncoderQuality. Any value from EncoderQualityMin to EncoderQualityMax may be used.
+const (
+	EncoderQualityMin    = C.kAudioConverterQuality_Min
+	EncoderQualityLow    = C.kAudioConverterQuality_Low
+	EncoderQualityMedium = C.kAudioConverterQuality_Medium
+	EncoderQualityHigh   = C.kAudioConverterQuality_High
+	EncoderQualityMax    = C.kAudioConverterQuality_Max
+)
+
+var errNoConverter = errors.New("extended audio file has no audio converter")
+
+// converter returns the audio converter that encodes client data for the file. If no client data format has been set
+// on a compressed output file, it is set to 16-bit linear PCM at the file's sample rate, the format the speech
+// synthesizer writes, to create the converter.
+func (eaf *ExtAudioFile) converter() (C.AudioConverterRef, error) {
+	var conv C.AudioConverterRef
+	sz := C.UInt32(unsafe.Sizeof(conv))
+	stat := C.ExtAudioFileGetProperty(eaf.ceaf, C.kExtAudioFileProperty_AudioConverter, &sz, unsafe.Pointer(&conv))
+	if stat != 0 {
+		return conv, osStatus(stat)
+	}
+	f := &eaf.af.format
+	if conv == nil && !eaf.af.input && f.mFormatID != C.kAudioFormatLinearPCM {
+		asbd := linearPCMFormat(float64(f.mSampleRate), int(f.mChannelsPerFrame), 16, false)
+		if err := eaf.setClientFormat(&asbd); err != nil {
+			return conv, err
+		}
+		stat = C.ExtAudioFileGetProperty(eaf.ceaf, C.kExtAudioFileProperty_AudioConverter, &sz, unsafe.Pointer(&conv))
+		if stat != 0 {
+			return conv, osStatus(stat)
+		}
+	}
+	if conv == nil {
+		return conv, errNoConverter
+	}
+	return conv, nil
+}
+
+// setConverterProperty sets a property on the audio converter that encodes client data for the file.
+func (eaf *ExtAudioFile) setConverterProperty(prop C.AudioConverterPropertyID, size C.UInt32, data unsafe.Pointer) error {
+	conv, err := eaf.converter()
+	if err != nil {
+		return err
+	}
+	stat := C.AudioConverterSetProperty(conv, prop, size, data)
+	if stat != 0 {
+		return osStatus(stat)
+	}
+	// setting a NULL converter configuration makes the ExtAudioFile pick up the changed converter settings
+	var config C.CFArrayRef
+	return osStatus(C.ExtAudioFileSetProperty(eaf.ceaf, C.kExtAudioFileProperty_ConverterConfig, C.UInt32(unsafe.Sizeof(config)), unsafe.Pointer(&config)))
+}
+
+// SetEncoderQuality sets the quality of the encoder used for compressed (e.g. AAC or ALAC) output.
+//
+// q ranges from EncoderQualityMin to EncoderQualityMax. Higher quality settings trade CPU time for fidelity, so they
+// lengthen the time it takes to synthesize to a compressed file; use a low setting where latency matters. If the
+// client data format of the file has not been set, it is set to 16-bit linear PCM at the sample rate of the file to
+// create the encoder. Setting the quality of linear PCM output fails, since no encoder is involved.
+func (eaf *ExtAudioFile) SetEncoderQuality(q int) error {
+	v := C.UInt32(q)
+	return eaf.setConverterProperty(C.kAudioConverterCodecQuality, C.UInt32(unsafe.Sizeof(v)), unsafe.Pointer(&v))
+}
+
+// SetBitRate sets the target bit rate in bits per second of the encoder used for compressed output. Like
+// SetEncoderQuality, it fails for linear PCM output. Encoders only support certain bit rates for each sample rate and
+// number of channels; AACSampleRate recommends a sample rate for AAC at a given bit rate.
+func (eaf *ExtAudioFile) SetBitRate(bps int) error {
+	v := C.UInt32(bps)
+	return eaf.setConverterProperty(C.kAudioConverterEncodeBitRate, C.UInt32(unsafe.Sizeof(v)), unsafe.Pointer(&v))
+}
+
+// BitRates returns the bit rates in bits per second that the encoder used for compressed output supports at the
+// sample rate and number of channels of the file, in ascending order, for choosing a value to pass to SetBitRate.
+// Where the encoder supports a continuous range of bit rates, its lowest and highest rates are returned. Like
+// SetBitRate, it sets the client data format of the file if it has not been set, and fails for linear PCM output.
+func (eaf *ExtAudioFile) BitRates() ([]int, error) {
+	conv, err := eaf.converter()
+	if err != nil {
+		return nil, err
+	}
+	var size C.UInt32
+	if stat := C.AudioConverterGetPropertyInfo(conv, C.kAudioConverterApplicableEncodeBitRates, &size, nil); stat != 0 {
+		return nil, osStatus(stat)
+	}
+	ranges := make([]C.AudioValueRange, int(size)/int(unsafe.Sizeof(C.AudioValueRange{})))
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+	if stat := C.AudioConverterGetProperty(conv, C.kAudioConverterApplicableEncodeBitRates, &size, unsafe.Pointer(&ranges[0])); stat != 0 {
+		return nil, osStatus(stat)
+	}
+	var rates []int
+	for _, r := range ranges[:int(size)/int(unsafe.Sizeof(C.AudioValueRange{}))] {
+		rates = append(rates, int(r.mMinimum))
+		if r.mMaximum != r.mMinimum {
+			rates = append(rates, int(r.mMaximum))
+		}
+	}
+	sort.Ints(rates)
+	return rates, nil
+}
+
+// AACSampleRate recommends a sample rate for AAC encoding at a bit rate in bits per second. High sample rates at low
+// bit rates leave too few bits for each band and produce audible artifacts, so lower bit rates get lower sample rates.
+func AACSampleRate(bps int) float64 {
+	switch {
+	case bps < 24000:
+		return 11025
+	case bps < 32000:
+		return 16000
+	case bps < 48000:
+		return 22050
+	case bps < 64000:
+		return 32000
+	default:
+		return 44100
+	}
+}
+
+var errGainFormat = errors.New("gain requires a 16-bit signed integer linear PCM file")
+
+// SetGain sets a linear gain that is applied to the audio samples as they are written to the file. A gain of 2 doubles
+// the amplitude of the output, and samples that would exceed the sample range are clipped.
+//
+// Unlike the speech channel volume, gain is applied after synthesis, so it can be used to normalize the output level
+// of different voices. The file must be 16-bit signed integer linear PCM.
+func (eaf *ExtAudioFile) SetGain(g float64) error {
+	f := &eaf.af.format
+	if f.mFormatID != C.kAudioFormatLinearPCM || f.mFormatFlags&C.kAudioFormatFlagIsSignedInteger == 0 || f.mBitsPerChannel != 16 {
+		return errGainFormat
+	}
+	eaf.af.gain = g
+	return nil
+}
+
+// ClientDataFormat returns the format of the audio data written to or read from the file by the client, which is
+// converted to or from the format of the file. When the speech synthesizer writes to the file, it sets the client
+// format to the native format of the voice, so after synthesis has started this reveals the voice's native sample rate.
+func (eaf *ExtAudioFile) ClientDataFormat() (StreamFormat, error) {
+	var asbd C.AudioStreamBasicDescription
+	size := C.UInt32(unsafe.Sizeof(asbd))
+	stat := C.ExtAudioFileGetProperty(eaf.ceaf, C.kExtAudioFileProperty_ClientDataFormat, &size, unsafe.Pointer(&asbd))
+	if stat != 0 {
+		return StreamFormat{}, osStatus(stat)
+	}
+	return streamFormat(&asbd), nil
+}
+
+// SetClientDataFormat sets the format of the audio data written to or read from the file by the client. CoreAudio
+// converts between the client format and the format of the file, resampling if their sample rates differ, so audio
+// can be read from a file at any rate.
+//
+// The speech synthesizer sets the client format to the native format of the voice when it starts writing to the
+// file, replacing any format set before. Its output is resampled to the rate of the file without further setup.
+func (eaf *ExtAudioFile) SetClientDataFormat(format StreamFormat) error {
+	asbd := format.asbd()
+	return eaf.setClientFormat(&asbd)
+}
+
+// setClientFormat sets the format of the audio data read from or written to the file by the client.
+func (eaf *ExtAudioFile) setClientFormat(asbd *C.AudioStreamBasicDescription) error {
+	return osStatus(C.ExtAudioFileSetProperty(eaf.ceaf, C.kExtAudioFileProperty_ClientDataFormat,
+		C.UInt32(unsafe.Sizeof(*asbd)), unsafe.Pointer(asbd)))
+}
+
+// readFrames reads up to len(p) bytes of whole interleaved frames in the client format into p, returning the number
+// of frames read. Zero frames are returned at the end of the file.
+func (eaf *ExtAudioFile) readFrames(p []byte, numchan int, bpf int) (int, error) {
+	frames := C.UInt32(len(p) / bpf)
+	if frames == 0 {
+		return 0, nil
+	}
+	stat := C.mactts_ext_read(eaf.ceaf, C.UInt32(numchan), unsafe.Pointer(&p[0]), C.UInt32(len(p)), &frames)
+	return int(frames), osStatus(stat)
+}
+
+var errBadClientFormat = errors.New("client data format must be interleaved packed linear PCM")
+
+// ReadFrames reads up to len(p) bytes of whole interleaved frames of audio from an input file into p, returning the
+// number of frames read. Zero frames are returned at the end of the file. The audio is decoded to the client data
+// format, which is the format of the file until it is changed with SetClientDataFormat. For a compressed file, the
+// client format must be set to a linear PCM format first.
+func (eaf *ExtAudioFile) ReadFrames(p []byte) (int, error) {
+	f, err := eaf.ClientDataFormat()
+	if err != nil {
+		return 0, err
+	}
+	if f.FormatID != FormatLinearPCM || f.FormatFlags&FormatFlagIsNonInterleaved != 0 || f.BytesPerFrame == 0 {
+		return 0, errBadClientFormat
+	}
+	return eaf.readFrames(p, int(f.ChannelsPerFrame), int(f.BytesPerFrame))
+}
+
+// writeFrames writes the whole interleaved frames in p, which are in the client format.
+func (eaf *ExtAudioFile) writeFrames(p []byte, numchan int, bpf int) error {
+	frames := C.UInt32(len(p) / bpf)
+	if frames == 0 {
+		return nil
+	}
+	return osStatus(C.mactts_ext_write(eaf.ceaf, C.UInt32(numchan), unsafe.Pointer(&p[0]), C.UInt32(len(p)), frames))
+}
+
+// Transcode decodes the audio file read from src and writes it to dst as an audio file of type dstType. The sample
+// rate and number of channels are preserved. Linear PCM output uses 16 bits per channel.
+//
+// src must either have a Size method, like *bytes.Reader and *io.SectionReader, or be an *os.File.
+func Transcode(dst ReadWriterAt, dstType AudioFileType, src io.ReaderAt) error {
+	size, err := readerSize(src)
+	if err != nil {
+		return err
+	}
+	in, err := OpenInputFile(src, size)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	ein, err := in.ExtAudioFile()
+	if err != nil {
+		return err
+	}
+	defer ein.Close()
+
+	rate := float64(in.format.mSampleRate)
+	numchan := int(in.format.mChannelsPerFrame)
+	out, err := newOutputFileType(dst, dstType, rate, numchan, 16)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	eout, err := out.ExtAudioFile()
+	if err != nil {
+		return err
+	}
+	defer eout.Close()
+
+	client := linearPCMFormat(rate, numchan, 16, false)
+	if err = ein.setClientFormat(&client); err != nil {
+		return err
+	}
+	if err = eout.setClientFormat(&client); err != nil {
+		return err
+	}
+
+	bpf := int(client.mBytesPerFrame)
+	buf := make([]byte, 4096*bpf)
+	for {
+		n, err := ein.readFrames(buf, numchan, bpf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if err = eout.writeFrames(buf[:n*bpf], numchan, bpf); err != nil {
+			return err
+		}
+	}
+	if err = eout.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// ErrNoAudio is returned by CheckAudio when no audio has been written to a file.
+var ErrNoAudio = errors.New("synthesis produced no audio")
+
+// CheckAudio returns ErrNoAudio if no audio frames have been written to the file. Synthesis can complete without an
+// error and yet produce no audio, for example when the voice fails to load, leaving a valid but empty file.
+func (eaf *ExtAudioFile) CheckAudio() error {
+	n, err := eaf.Tell()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoAudio
+	}
+	return nil
+}
+
 // Tell returns the file offset for the internal ExtAudioFile in sample frames.
 func (eaf *ExtAudioFile) Tell() (ofs int64, err error) {
 	err = osStatus(C.ExtAudioFileTell(eaf.ceaf, (*C.SInt64)(&ofs)))
@@ -190,6 +905,7 @@ func (eaf *ExtAudioFile) Close() error {
 	if eaf.ceaf == nil {
 		return nil
 	}
+	atomic.AddInt64(&liveExtAudioFiles, -1)
 	stat := C.ExtAudioFileDispose(eaf.ceaf)
 	eaf.ceaf = nil
 	eaf.af = nil
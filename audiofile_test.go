@@ -0,0 +1,58 @@
+package mactts
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// TestWAVEFinalize checks that a WAVE file written through the callbacks is finalized with RIFF and data chunk sizes
+// that match the audio written. CoreAudio reads back parts of the file to update the header when it is closed, which
+// fails if the read callback reports a short read within the file as the end of the file.
+func TestWAVEFinalize(t *testing.T) {
+	const frames = 4410
+	var f memFile
+	af, err := NewOutputWAVEFile(&f, 22050, 1, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eaf, err := af.ExtAudioFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm := make([]byte, frames*2)
+	for i := 0; i < frames; i++ {
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(i))
+	}
+	if err = eaf.writeFrames(pcm, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err = eaf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = af.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := f.b
+	if len(b) < 12 || string(b[0:4]) != "RIFF" || string(b[8:12]) != "WAVE" {
+		t.Fatalf("not a WAVE file: % x", b[:12])
+	}
+	if size := binary.LittleEndian.Uint32(b[4:8]); int(size) != len(b)-8 {
+		t.Errorf("RIFF chunk size is %d, want %d", size, len(b)-8)
+	}
+	for ofs := 12; ofs+8 <= len(b); {
+		id := string(b[ofs : ofs+4])
+		size := int(binary.LittleEndian.Uint32(b[ofs+4 : ofs+8]))
+		if id == "data" {
+			if size != len(pcm) {
+				t.Errorf("data chunk size is %d, want %d", size, len(pcm))
+			}
+			if ofs+8+size > len(b) {
+				t.Errorf("data chunk of %d bytes at %d extends past the end of the %d byte file", size, ofs, len(b))
+			}
+			return
+		}
+		ofs += 8 + size + size&1
+	}
+	t.Error("no data chunk")
+}
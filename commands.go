@@ -0,0 +1,119 @@
+package mactts
+
+import "strconv"
+import "strings"
+
+// EscapeText returns s modified so that the synthesizer speaks it verbatim instead of interpreting any part of it as
+// an embedded command. It assumes the channel uses the default "[[" and "]]" command delimiters.
+//
+// An embedded command can only begin with two adjacent opening brackets, so EscapeText separates each such pair with
+// a space. This does not change how the text is spoken. To speak text on a channel that never interprets commands, use
+// Channel.DisableCommands instead.
+func EscapeText(s string) string {
+	if !strings.Contains(s, "[[") {
+		return s
+	}
+	buf := make([]byte, 0, len(s)+len(s)/2)
+	for i := 0; i < len(s); i++ {
+		if s[i] == '[' && i > 0 && s[i-1] == '[' {
+			buf = append(buf, ' ')
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// Prosody describes how a segment of text is spoken. A zero field leaves that aspect at the default of the voice.
+type Prosody struct {
+	Rate   float64 // speech rate in words per minute
+	Pitch  float64 // pitch base as a MIDI note number, as for Channel.SetPitchBase
+	Volume float64 // volume from 0 to 1, as for Channel.SetVolume
+}
+
+// Segment is a passage of text spoken with a given prosody.
+type Segment struct {
+	Text    string
+	Prosody Prosody
+}
+
+// ProsodyScript combines segments into a single string of text with embedded commands that change the prosody
+// between segments, so that an expressive passage can be spoken with one call to SpeakString. The text of each segment
+// is escaped with EscapeText and the segments are otherwise concatenated as they are.
+//
+// Only the aspects of the prosody that change between segments are set. When a segment returns an aspect to the
+// default of the voice, or after the last segment, the channel is reset with an rset command, which also discards any
+// settings made with methods such as Channel.SetRate.
+func ProsodyScript(segments []Segment) string {
+	var buf []byte
+	var cur Prosody
+	for _, seg := range segments {
+		next := seg.Prosody
+		if (cur.Rate != 0 && next.Rate == 0) || (cur.Pitch != 0 && next.Pitch == 0) || (cur.Volume != 0 && next.Volume == 0) {
+			buf = appendCommand(buf, "rset 0")
+			cur = Prosody{}
+		}
+		var cmds []string
+		if next.Rate != cur.Rate {
+			cmds = append(cmds, "rate "+formatCommandNumber(next.Rate))
+		}
+		if next.Pitch != cur.Pitch {
+			cmds = append(cmds, "pbas "+formatCommandNumber(next.Pitch))
+		}
+		if next.Volume != cur.Volume {
+			cmds = append(cmds, "volm "+formatCommandNumber(next.Volume))
+		}
+		if len(cmds) > 0 {
+			buf = appendCommand(buf, strings.Join(cmds, "; "))
+		}
+		cur = next
+		buf = appendEscaped(buf, seg.Text)
+	}
+	if cur != (Prosody{}) {
+		buf = appendCommand(buf, "rset 0")
+	}
+	return string(buf)
+}
+
+// appendCommand appends an embedded command to buf, separating it from a bracket that ends the text before it so that
+// the delimiter is not preceded by another bracket.
+func appendCommand(buf []byte, cmd string) []byte {
+	if len(buf) > 0 && buf[len(buf)-1] == '[' {
+		buf = append(buf, ' ')
+	}
+	buf = append(buf, "[["...)
+	buf = append(buf, cmd...)
+	return append(buf, "]]"...)
+}
+
+// appendEscaped appends s to buf escaped as by EscapeText, also separating a bracket that starts s from one that ends
+// buf, as when one segment ends with a bracket and the next begins with one.
+func appendEscaped(buf []byte, s string) []byte {
+	if len(buf) > 0 && buf[len(buf)-1] == '[' && len(s) > 0 && s[0] == '[' {
+		buf = append(buf, ' ')
+	}
+	return append(buf, EscapeText(s)...)
+}
+
+func formatCommandNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// PronounceAs returns text to splice into otherwise normal text in place of word, so that word is pronounced as
+// phonemes. The phonemes use the same notation as SpeakPhonemes and are spoken in phoneme input mode, which is
+// switched back to text input afterwards. The word itself is not spoken; if phonemes is empty, the escaped word is
+// returned instead. Like EscapeText, PronounceAs assumes the default command delimiters.
+//
+// phonemes are checked against the American English phoneme set, as by Dictionary.AddEntry, so that they cannot end
+// phoneme input mode or embed other commands. If they use any other symbol, including a bracket, a *PhonemeError with
+// its position is returned.
+//
+// PronounceAs is a lightweight alternative to a pronunciation dictionary for one-off fixes.
+func PronounceAs(word, phonemes string) (string, error) {
+	if phonemes == "" {
+		return EscapeText(word), nil
+	}
+	if err := validatePhonemes(phonemes); err != nil {
+		return "", err
+	}
+	return phonemePrefix + phonemes + phonemeSuffix, nil
+}
@@ -0,0 +1,90 @@
+package mactts
+
+import (
+	"strings"
+	"testing"
+)
+
+// isEscapeOf reports whether e is s with spaces inserted only between adjacent opening brackets, as by EscapeText.
+func isEscapeOf(e, s string) bool {
+	j := 0
+	for i := 0; i < len(e); i++ {
+		if j < len(s) && e[i] == s[j] {
+			j++
+			continue
+		}
+		if e[i] == ' ' && i > 0 && e[i-1] == '[' && i+1 < len(e) && e[i+1] == '[' {
+			continue
+		}
+		return false
+	}
+	return j == len(s)
+}
+
+func FuzzEscapeText(f *testing.F) {
+	for _, s := range []string{"", "hello", "[", "[[", "[[[", "[ [", "]]", "say [[rate 300]] this", "[[inpt PHON]]", "a[[b[[[c"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		e := EscapeText(s)
+		if strings.Contains(e, "[[") {
+			t.Fatalf("EscapeText(%q) = %q contains a command delimiter", s, e)
+		}
+		if !isEscapeOf(e, s) {
+			t.Fatalf("EscapeText(%q) = %q does not round-trip", s, e)
+		}
+	})
+}
+
+func FuzzProsodyScript(f *testing.F) {
+	for _, s := range []string{"", "hello", "[", "[[", "a [", "[ b", "say [[rate 300]] this"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		// the only commands in the script are those made for the prosody, even where a segment ends with a bracket
+		script := ProsodyScript([]Segment{{Text: s, Prosody: Prosody{Rate: 200}}, {Text: s}})
+		want := "[[rate 200]]" + s + "[[rset 0]]" + s
+		for i := range script {
+			if strings.HasPrefix(script[i:], "[[") && !strings.HasPrefix(script[i:], "[[rate 200]]") && !strings.HasPrefix(script[i:], "[[rset 0]]") {
+				t.Fatalf("ProsodyScript of %q = %q has a command delimiter at %d", s, script, i)
+			}
+		}
+		if !isEscapeOf(script, want) {
+			t.Fatalf("ProsodyScript of %q = %q does not round-trip to %q", s, script, want)
+		}
+
+		// segments with the same prosody are joined without forming a delimiter between them
+		if script = ProsodyScript([]Segment{{Text: s}, {Text: s}}); strings.Contains(script, "[[") || !isEscapeOf(script, s+s) {
+			t.Fatalf("ProsodyScript of %q twice = %q", s, script)
+		}
+	})
+}
+
+func FuzzPronounceAs(f *testing.F) {
+	f.Add("apple", "1AEpAXl")
+	f.Add("Nginx", "1EHnJIHn2EHks")
+	f.Add("Nginx", "EH1njInEHks")
+	f.Add("x", "AX]][[rate 500]][[inpt PHON")
+	f.Add("[[slnc 500]]", "")
+	f.Fuzz(func(t *testing.T, word, phonemes string) {
+		p, err := PronounceAs(word, phonemes)
+		if phonemes == "" {
+			if err != nil || p != EscapeText(word) {
+				t.Fatalf("PronounceAs(%q, \"\") = %q, %v, want %q", word, p, err, EscapeText(word))
+			}
+			return
+		}
+		if strings.ContainsAny(phonemes, "[]") && err == nil {
+			t.Fatalf("PronounceAs(%q, %q) accepted a command delimiter", word, phonemes)
+		}
+		if err != nil {
+			if _, ok := err.(*PhonemeError); !ok {
+				t.Fatalf("PronounceAs(%q, %q) returned %v, want a *PhonemeError", word, phonemes, err)
+			}
+			return
+		}
+		if p != phonemePrefix+phonemes+phonemeSuffix || strings.Count(p, "[[") != 2 || strings.Count(p, "]]") != 2 {
+			t.Fatalf("PronounceAs(%q, %q) = %q", word, phonemes, p)
+		}
+	})
+}
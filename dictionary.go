@@ -0,0 +1,122 @@
+package mactts
+
+/*
+#include <SpeechSynthesis.h>
+
+// mactts_use_pronunciations installs a pronunciation dictionary built from parallel arrays of spellings and phonemes
+// on a speech channel.
+static inline OSErr mactts_use_pronunciations(SpeechChannel chan, CFStringRef locale, CFIndex n, CFStringRef *spellings, CFStringRef *phonemes) {
+  CFMutableArrayRef entries = CFArrayCreateMutable(NULL, n, &kCFTypeArrayCallBacks);
+  CFMutableDictionaryRef dict = CFDictionaryCreateMutable(NULL, 0, &kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+  CFDateRef date = CFDateCreate(NULL, CFAbsoluteTimeGetCurrent());
+  OSErr ret;
+  CFIndex i;
+
+  for (i = 0; i < n; i++) {
+    CFMutableDictionaryRef entry = CFDictionaryCreateMutable(NULL, 0, &kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+    CFDictionarySetValue(entry, kSpeechDictionaryEntrySpelling, spellings[i]);
+    CFDictionarySetValue(entry, kSpeechDictionaryEntryPhonemes, phonemes[i]);
+    CFArrayAppendValue(entries, entry);
+    CFRelease(entry);
+  }
+  CFDictionarySetValue(dict, kSpeechDictionaryLocaleIdentifier, locale);
+  CFDictionarySetValue(dict, kSpeechDictionaryModificationDate, date);
+  CFDictionarySetValue(dict, kSpeechDictionaryPronunciations, entries);
+  ret = UseSpeechDictionary(chan, dict);
+  CFRelease(date);
+  CFRelease(entries);
+  CFRelease(dict);
+  return ret;
+}
+*/
+import "C"
+import "errors"
+import "strings"
+
+// phonemeVowels are the two letter vowel symbols of the American English phoneme set.
+var phonemeVowels = []string{"AE", "EY", "AO", "AX", "IY", "EH", "IH", "AY", "IX", "AA", "UW", "UH", "UX", "OW", "AW", "OY"}
+
+// phonemeSymbols are the other symbols of the American English phoneme set: the one letter consonants; the stress
+// marks 1 and 2 and syllable mark =; the prominence marks ~ (unstressed), _ (normal word prominence) and + (emphasized);
+// the prosody controls / and \ (pitch rise and fall) and > and < (lengthen and shorten); % (silence) and @ (breath
+// intake); the punctuation allowed in phoneme input; and the space between words.
+const phonemeSymbols = "bCdDfghJklmnNprsStTvwyzZ12=~_+/\\><%@.,!?;:() "
+
+// validatePhonemes checks that phonemes only uses symbols of the American English phoneme set, and returns a
+// *PhonemeError with the position of the first one that is not. Symbols are case sensitive.
+func validatePhonemes(phonemes string) error {
+	for i := 0; i < len(phonemes); {
+		if i+2 <= len(phonemes) && isVowel(phonemes[i:i+2]) {
+			i += 2
+			continue
+		}
+		if strings.IndexByte(phonemeSymbols, phonemes[i]) < 0 {
+			return &PhonemeError{Pos: i}
+		}
+		i++
+	}
+	return nil
+}
+
+func isVowel(s string) bool {
+	for _, v := range phonemeVowels {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+var errEmptySpelling = errors.New("dictionary entry has an empty spelling")
+
+// Dictionary is a pronunciation dictionary that overrides how the synthesizer speaks words. Entries are added with
+// AddEntry and the dictionary is installed on a channel with UseSpeechDictionary.
+type Dictionary struct {
+	locale    string
+	spellings []string
+	phonemes  []string
+}
+
+// NewDictionary creates an empty pronunciation dictionary for the language of a locale identifier such as en_US.
+func NewDictionary(locale string) *Dictionary {
+	return &Dictionary{locale: locale}
+}
+
+// AddEntry adds a word to the dictionary, to be spoken as phonemes, in the notation accepted by SpeakPhonemes, as in
+// d.AddEntry("Nginx", "1EHnJIHn2EHks"). If phonemes uses a symbol outside the American English phoneme set, a
+// *PhonemeError with its position is returned and the entry is not added. Phonemes in other notations are rejected
+// rather than guessed at: "EH1njInEHks", with a stress mark after its vowel and the lowercase j and I that are not
+// symbols of the set, fails at position 4.
+func (d *Dictionary) AddEntry(word, phonemes string) error {
+	if word == "" {
+		return errEmptySpelling
+	}
+	if err := validatePhonemes(phonemes); err != nil {
+		return err
+	}
+	d.spellings = append(d.spellings, word)
+	d.phonemes = append(d.phonemes, phonemes)
+	return nil
+}
+
+// UseSpeechDictionary installs the pronunciations of d on the channel. They override the pronunciations of
+// dictionaries installed earlier, so a channel can be given the vocabulary of the text it speaks.
+func (c *Channel) UseSpeechDictionary(d *Dictionary) error {
+	n := len(d.spellings)
+	// one spare element, so that there is a first element to pass for an empty dictionary
+	spellings := make([]C.CFStringRef, n+1)
+	phonemes := make([]C.CFStringRef, n+1)
+	for i := 0; i < n; i++ {
+		spellings[i] = cfstring(d.spellings[i])
+		phonemes[i] = cfstring(d.phonemes[i])
+	}
+	locale := cfstring(d.locale)
+	defer func() {
+		for i := 0; i < n; i++ {
+			C.CFRelease(C.CFTypeRef(spellings[i]))
+			C.CFRelease(C.CFTypeRef(phonemes[i]))
+		}
+		C.CFRelease(C.CFTypeRef(locale))
+	}()
+	return osError(C.mactts_use_pronunciations(c.csc, locale, C.CFIndex(n), &spellings[0], &phonemes[0]))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errCallPanicked is the error waiting callers get when the coalesced call panicked.
+var errCallPanicked = errors.New("coalesced synthesis failed")
+
+// coalescedCall is a synthesis in progress or completed for a coalescer.
+type coalescedCall struct {
+	done    chan struct{} // closed when res and err are set
+	res     *synthResult
+	err     error
+	waiters int                // callers still waiting for the results, guarded by the coalescer's mu
+	cancel  context.CancelFunc // cancels the context of the call
+}
+
+// coalescer shares one synthesis among concurrent identical requests, so that a burst of requests for a popular
+// phrase is only synthesized once.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// do calls fn and returns its results, unless a call for the same key is already in flight, in which case it waits for
+// that call and returns its results instead. shared reports whether the results came from another call. Results are
+// not retained once all waiting callers have them.
+//
+// The context passed to fn is canceled only once the ctx of every caller waiting for the call is done, so a shared
+// call is stopped when all of its clients have gone away, but not while any of them remains. A caller other than the
+// one running fn returns ctx.Err() as soon as its ctx is done.
+func (c *coalescer) do(ctx context.Context, key string, fn func(ctx context.Context) (*synthResult, error)) (res *synthResult, err error, shared bool) {
+	c.mu.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]*coalescedCall)
+	}
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.res, call.err, true
+		case <-ctx.Done():
+			c.leave(key, call)
+			return nil, ctx.Err(), true
+		}
+	}
+	callCtx, cancel := context.WithCancel(context.Background())
+	call := &coalescedCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	// the caller running fn leaves the call when its ctx is done, but keeps running fn for any other callers
+	go func() {
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			c.leave(key, call)
+		}
+	}()
+
+	// the call is finished even if fn panics, so that waiting and later callers are not blocked forever
+	defer func() {
+		c.mu.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		c.mu.Unlock()
+		cancel()
+		close(call.done)
+	}()
+	call.err = errCallPanicked
+	call.res, call.err = fn(callCtx)
+	return call.res, call.err, false
+}
+
+// leave removes a waiting caller from call. When no callers remain, the call is canceled and forgotten, so that a
+// later request for the same key starts a new call rather than sharing the results of the canceled one.
+func (c *coalescer) leave(key string, call *coalescedCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call.waiters--; call.waiters == 0 {
+		call.cancel()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitForWaiters waits until n callers are waiting for the call for key.
+func waitForWaiters(c *coalescer, key string, n int) {
+	for {
+		c.mu.Lock()
+		w := c.calls[key].waiters
+		c.mu.Unlock()
+		if w == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestCoalescerCancel checks that a shared call keeps running while any caller waits for it, and is canceled once the
+// contexts of all of its callers are done.
+func TestCoalescerCancel(t *testing.T) {
+	var c coalescer
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err, _ := c.do(ctx1, "k", func(ctx context.Context) (*synthResult, error) {
+			close(started)
+			<-ctx.Done()
+			close(stopped)
+			return nil, ctx.Err()
+		})
+		errs <- err
+	}()
+	<-started
+	go func() {
+		_, err, shared := c.do(ctx2, "k", func(ctx context.Context) (*synthResult, error) {
+			t.Error("second call was not coalesced")
+			return nil, nil
+		})
+		if !shared {
+			t.Error("second call was not shared")
+		}
+		errs <- err
+	}()
+	waitForWaiters(&c, "k", 2)
+
+	cancel1()
+	select {
+	case <-stopped:
+		t.Fatal("call canceled while a caller was still waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel2()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call not canceled after every caller had gone")
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != context.Canceled {
+			t.Errorf("do returned %v, want %v", err, context.Canceled)
+		}
+	}
+}
+
+// TestCoalescerPanic checks that callers waiting for a call that panics are released with an error.
+func TestCoalescerPanic(t *testing.T) {
+	var c coalescer
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		c.do(context.Background(), "k", func(ctx context.Context) (*synthResult, error) {
+			close(started)
+			<-release
+			panic("synthesis")
+		})
+	}()
+	<-started
+	done := make(chan error)
+	go func() {
+		_, err, _ := c.do(context.Background(), "k", nil)
+		done <- err
+	}()
+	waitForWaiters(&c, "k", 2)
+	close(release)
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("waiting caller got no error from a call that panicked")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting caller not released after the call panicked")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Log levels for the -log-level flag, in increasing order of severity.
+const (
+	levelDebug = iota
+	levelInfo
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "error"}
+
+// logThreshold is the minimum level of messages that are logged.
+var logThreshold = levelError
+
+// parseLogLevel returns the log level with the given name.
+func parseLogLevel(name string) (int, error) {
+	for level, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// logKV logs msg at level as a line of key=value pairs, which are given as alternating keys and values. Values
+// containing spaces or quotes are quoted.
+func logKV(level int, msg string, kv ...interface{}) {
+	if level < logThreshold {
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "level=%s msg=%s", levelNames[level], logValue(msg))
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&buf, " %v=%s", kv[i], logValue(fmt.Sprint(kv[i+1])))
+	}
+	log.Print(buf.String())
+}
+
+func logValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
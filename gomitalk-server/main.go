@@ -2,16 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"bitbucket.org/ww/goautoneg"
@@ -21,17 +27,56 @@ import (
 	"encoding/hex"
 	"strconv"
 	"math"
+	"mime/multipart"
+	"net/textproto"
 )
 
 const (
-	etagGeneration uint32 = 2
+	etagGeneration uint32 = 3
 	jsonMIMEType = "application/json; charset=utf-8"
 	textMIMEType = "text/plain; charset=utf-8"
+
+	// synthTimeout bounds the time spent synthesizing a request, including waiting for a speech channel.
+	synthTimeout = 1 * time.Minute
+
+	// channelRetryBackoff is the wait between attempts to open a speech channel when the synthesizer is out of channels.
+	channelRetryBackoff = 100 * time.Millisecond
 )
 
 var (
 	httpAddr = flag.String("http", ":8080", "Listen for HTTP connections on this address.")
 	useEtag = flag.Bool("etag", true, "Produce Etags for equivalent utterances.")
+	logLevel = flag.String("log-level", "error", "Minimum level of messages to log: debug, info or error. Per-request synthesis details are logged at info.")
+	maxDuration = flag.Duration("max-duration", 0, "Reject requests for speech longer than this, e.g. 2m. 0 is unlimited.")
+	contentEtag = flag.Bool("content-etag", false, "Compute Etags from the synthesized audio instead of the request parameters. Requires synthesizing before a 304 can be sent.")
+	allowCommands = flag.Bool("commands", false, "Allow embedded speech commands in the text to synthesize.")
+	unhealthyExit = flag.Int("unhealthy-exit", 0, "Exit after this many consecutive failed health checks so a supervisor such as launchd can restart the server. 0 never exits.")
+	fallbackVoices = flag.String("fallback", "Fred", "Comma separated voice names or locales (e.g. en_US) to try in order when the requested voice is not installed or no voice is requested.")
+)
+
+// synthStats publishes synthesis latency totals in milliseconds on /debug/vars. Averages can be found by dividing
+// by the number of requests.
+var synthStats = expvar.NewMap("synthesis")
+
+func init() {
+	// objects that are not closed by the handlers hold synthesizer and CoreAudio resources until they are finalized
+	expvar.Publish("live_objects", expvar.Func(func() interface{} {
+		channels, audioFiles, extAudioFiles := mactts.LiveCounts()
+		return map[string]int64{"channels": channels, "audio_files": audioFiles, "ext_audio_files": extAudioFiles}
+	}))
+	mactts.SetLeakHandler(func(kind string) {
+		logKV(levelError, "leaked object finalized", "kind", kind)
+	})
+}
+
+var (
+	// startTime is the default Last-Modified time of responses. The voices and other server state do not change while
+	// the server is running.
+	startTime = time.Now()
+
+	// synthModTime is the Last-Modified time of synthesized speech. Output for a given request can change whenever
+	// the server or the voices installed on the system change, which only take effect when the server is restarted.
+	synthModTime = startTime
 )
 
 // stripPort removes the port specification from an address
@@ -85,15 +130,13 @@ func runHandler(resp http.ResponseWriter, req *http.Request,
 
 	req.Body = http.MaxBytesReader(resp, req.Body, 131072)
 	req.ParseForm()
-	var rb ResponseBuffer
+	rb := ResponseBuffer{target: resp}
+	// nginx Etag handling breaks if Last-Modified is not set; handlers may replace it
+	rb.Header().Set("Last-Modified", httpTime(startTime))
+	// For nginx proxy cache, this allows the support of byte ranges. Not sure how to get around this on the nginx side.
+	rb.Header().Set("Accept-Ranges", "bytes")
 	err := fn(&rb, req)
 	if err == nil {
-		// nginx Etag handling breaks if Last-Modified is not set
-		if rb.Header()["Last-Modified"] == nil {
-			rb.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
-		}
-		// For nginx proxy cache, this allows the support of byte ranges. Not sure how to get around this on the nginx side.
-		rb.Header().Set("Accept-Ranges", "bytes")
 		rb.WriteTo(resp)
 	} else if e, ok := err.(*httpError); ok {
 		if e.status >= 500 {
@@ -128,15 +171,24 @@ func (h apiHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	runHandler(resp, req, h, handleJSONError)
 }
 
-// checkEtagDone returns true if we are certain that the request can be signaled as StatusNotModified.
-func checkEtagDone(req *http.Request, etag string) bool {
+// httpTime formats t for an HTTP header such as Last-Modified. http.TimeFormat always names the zone GMT, so t must
+// be converted to UTC first.
+func httpTime(t time.Time) string {
+	return t.UTC().Format(http.TimeFormat)
+}
+
+// checkNotModified returns true if we are certain that the request can be signaled as StatusNotModified.
+// If-None-Match is checked against etag and takes precedence over If-Modified-Since, which is checked against modtime.
+func checkNotModified(req *http.Request, etag string, modtime time.Time) bool {
 	if inm := req.Header.Get("If-None-Match"); inm != "" {
 		if etag == "" {
 			return false
 		}
-		if inm == etag || inm == "*" {
-			return true
-		}
+		return inm == etag || inm == "*"
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" && !modtime.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modtime.Truncate(time.Second).After(t)
 	}
 	return false
 }
@@ -146,16 +198,32 @@ func speechHandler(resp http.ResponseWriter, req *http.Request) error {
 	if msg == "" {
 		return &httpError{status: http.StatusBadRequest, err: errors.New("missing `text` parameter")}
 	}
-
+	if err := mactts.ValidateText(msg); err != nil {
+		return &httpError{status: http.StatusBadRequest, err: fmt.Errorf("invalid `text` parameter: %v", err)}
+	}
 	// name match is highest priority, followed by gender/locale match, and then fallback
-	var voiceSpec *mactts.VoiceSpec
-	voiceName := req.FormValue("voice")
-	if voiceName != "" {
+	var voice *Voice
+	if voiceID := req.FormValue("voice_id"); voiceID != "" {
+		v := voices.FindByID(voiceID)
+		if v == nil {
+			v = fallbackVoice()
+		}
+		if v == nil {
+			return &httpError{status: http.StatusNotFound, err: fmt.Errorf("voice `%s` not found", voiceID)}
+		}
+		voice = v
+	} else if voiceName := req.FormValue("voice"); voiceName != "" {
 		v := voices.FindByName(voiceName)
+		if v == nil {
+			v = voices.FindByID(voiceName)
+		}
+		if v == nil {
+			v = fallbackVoice()
+		}
 		if v == nil {
 			return &httpError{status: http.StatusNotFound, err: fmt.Errorf("voice `%s` not found", voiceName)}
 		}
-		voiceSpec = v.Spec()
+		voice = v
 	} else {
 		var gender mactts.Gender
 		switch req.FormValue("gender") {
@@ -171,23 +239,27 @@ func speechHandler(resp http.ResponseWriter, req *http.Request) error {
 			return &httpError{status: http.StatusBadRequest, err: fmt.Errorf("invalid `gender` parameter")}
 		}
 		locale := req.FormValue("lang")
-		if gender != mactts.GenderNil || locale != "" {
+		// without a lang, the language of the text chooses among the voices, as a hint that need not be met
+		if contentLang := req.FormValue("content-lang"); contentLang != "" && locale == "" {
+			voice = voices.MatchLanguage(gender, contentLang)
+		}
+		if voice == nil && (gender != mactts.GenderNil || locale != "") {
 			v := voices.Match(gender, locale)
 			if v == nil {
 				return &httpError{status: http.StatusNotFound, err: errors.New("cannot find voice with specified gender and/or language")}
 			}
-			voiceSpec = v.Spec()
+			voice = v
 		}
 	}
 
-	// finally if no matcher hits, try to load a universally available default
-	if voiceSpec == nil {
-		v := voices.FindByName("Fred")
-		if v == nil {
+	// finally if no matcher hits, try the configured fallback voices
+	if voice == nil {
+		voice = fallbackVoice()
+		if voice == nil {
 			return &httpError{status: http.StatusNotFound, err: errors.New("unable to find suitable voice")}
 		}
-		voiceSpec = v.Spec()
 	}
+	voiceSpec := voice.Spec()
 
 	var sampleRate int
 	switch req.FormValue("samplerate") {
@@ -221,6 +293,10 @@ func speechHandler(resp http.ResponseWriter, req *http.Request) error {
 		rate = uint16(pv)
 	}
 
+	if *maxDuration > 0 && estimateDuration(msg, rate) > *maxDuration {
+		return errTooLong
+	}
+
 	var pitch float64
 
 	if p := req.FormValue("pitch"); p != "" {
@@ -231,117 +307,544 @@ func speechHandler(resp http.ResponseWriter, req *http.Request) error {
 		}
 	}
 
-	if req.Method == "POST" {
-		attachmentName := req.FormValue("attachment")
-		if attachmentName != "" {
-			resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", attachmentName))
-		}
+	if attachmentName := sanitizeFilename(req.FormValue("attachment")); attachmentName != "" {
+		resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", attachmentName))
 	}
-	f := resp.(*ResponseBuffer)
-
 	acceptMimeType := req.FormValue("type")
 	if acceptMimeType == "" {
 		acceptMimeType = req.Header.Get("Accept")
 	}
-	acceptType := goautoneg.Negotiate(acceptMimeType, []string{
+	audioTypes := []string{
 		"audio/wave", "audio/wav", "audio/x-wav", "audio/vnd.wav",
 		"audio/mp4",
-	})
+	}
+	acceptType := goautoneg.Negotiate(acceptMimeType, append(audioTypes, "multipart/mixed"))
+
+	// a multipart response holds the metadata and the audio in the preferred audio type
+	wantMultipart := acceptType == "multipart/mixed"
+	if wantMultipart {
+		acceptType = goautoneg.Negotiate(acceptMimeType, audioTypes)
+	}
 
-	responseType := "audio/wav"
+	audioType := "audio/wav"
 	newFileFunc := mactts.NewOutputWAVEFile
 	if acceptType == "audio/mp4" {
-		responseType = "audio/mp4"
+		audioType = "audio/mp4"
 		newFileFunc = mactts.NewOutputAACFile
 	}
+	responseType := audioType
+	if wantMultipart {
+		responseType = "multipart/mixed"
+	}
+
+	// AAC is encoded at the requested bit rate, with a sample rate suited to the bit rate unless one was requested
+	var bitRate int
+	if p := req.FormValue("bitrate"); p != "" && acceptType == "audio/mp4" {
+		pv, err := strconv.ParseUint(p, 10, 32)
+		if err != nil || pv == 0 {
+			return &httpError{status: http.StatusBadRequest, err: errors.New("invalid `bitrate` parameter")}
+		}
+		bitRate = int(pv)
+		if req.FormValue("samplerate") == "" {
+			sampleRate = int(mactts.AACSampleRate(bitRate))
+		}
+	}
 
-	resp.Header().Set("Content-Type", responseType)
+	// with timings, only the word timings of the synthesized audio are returned
+	wantTimings := req.FormValue("timings") == "1"
+	wantPhonemes := req.FormValue("include") == "phonemes"
+	if wantTimings {
+		responseType = jsonMIMEType
+	}
+
+	resp.Header().Set("Last-Modified", httpTime(synthModTime))
+
+	// the key identifies equivalent utterances, for both the Etag and coalescing identical requests
+	etagBuf := make([]byte, 22, 52+len(msg))
+	binary.BigEndian.PutUint32(etagBuf, etagGeneration)
+	binary.BigEndian.PutUint32(etagBuf[4:], uint32(sampleRate))
+	binary.BigEndian.PutUint16(etagBuf[8:], rate)
+	binary.BigEndian.PutUint64(etagBuf[10:], math.Float64bits(pitch))
+	binary.BigEndian.PutUint32(etagBuf[18:], uint32(bitRate))
+	vsb, _ := voiceSpec.MarshalBinary()
+	etagBuf = append(etagBuf, vsb...)
+	etagBuf = append(etagBuf, responseType...)
+	etagBuf = append(etagBuf, audioType...)
+	if wantPhonemes {
+		etagBuf = append(etagBuf, "+phonemes"...)
+	}
+	etagBuf = append(etagBuf, msg...)
+	etagSum := md5.New()
+	etagSum.Write(etagBuf)
+
+	key := hex.EncodeToString(etagSum.Sum(nil))
+
+	// the key is also the multipart boundary, so that identical requests get identical bodies
+	if wantMultipart {
+		resp.Header().Set("Content-Type", "multipart/mixed; boundary="+key)
+	} else {
+		resp.Header().Set("Content-Type", responseType)
+	}
 
-	if *useEtag {
-		// compute the Etag
-		etagBuf := make([]byte, 18, 48+len(msg))
-		binary.BigEndian.PutUint32(etagBuf, etagGeneration)
-		binary.BigEndian.PutUint32(etagBuf[4:], uint32(sampleRate))
-		binary.BigEndian.PutUint16(etagBuf[8:], rate)
-		binary.BigEndian.PutUint64(etagBuf[10:], math.Float64bits(pitch))
-		vsb, _ := voiceSpec.MarshalBinary()
-		etagBuf = append(etagBuf, vsb...)
-		etagBuf = append(etagBuf, responseType...)
-		etagBuf = append(etagBuf, msg...)
-		etagSum := md5.New()
-		etagSum.Write(etagBuf)
+	// log the details and outcome of each request for capacity planning
+	reqStart := time.Now()
+	outcome := "error"
+	var nbytes int
+	defer func() {
+		logKV(levelInfo, "synthesis", "voice", voice.Name, "format", responseType, "sample_rate", sampleRate,
+			"text_len", len(msg), "duration_ms", int64(time.Since(reqStart)/time.Millisecond), "bytes", nbytes, "cache", outcome)
+	}()
 
-		etag := hex.EncodeToString(etagSum.Sum(nil))
+	var etag string
+	if *useEtag && !*contentEtag {
+		etag = key
 		resp.Header().Set("Etag", etag)
+	}
+
+	if checkNotModified(req, etag, synthModTime) {
+		outcome = "not_modified"
+		resp.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	sr := &synthRequest{
+		msg:        msg,
+		voiceSpec:  voiceSpec,
+		sampleRate: sampleRate,
+		rate:       rate,
+		pitch:      pitch,
+		bitRate:    bitRate,
+		newFile:    newFileFunc,
+		timings:    wantTimings || wantMultipart,
+		phonemes:   wantPhonemes,
+	}
+	// the synthesis may be shared with other requests, so it is only canceled once all of their clients have gone
+	res, err, shared := synthCalls.do(req.Context(), key, func(ctx context.Context) (*synthResult, error) {
+		ctx, cancel := context.WithTimeout(ctx, synthTimeout)
+		defer cancel()
+		return synthesize(ctx, sr)
+	})
+	if err != nil {
+		return err
+	}
+	outcome = "miss"
+	if shared {
+		outcome = "coalesced"
+		synthStats.Add("coalesced", 1)
+	}
+	if res.firstAudio > 0 {
+		resp.Header().Set("X-First-Audio-Ms", strconv.FormatInt(int64(res.firstAudio/time.Millisecond), 10))
+	}
+	if wantPhonemes {
+		resp.Header().Set("X-Phonemes", headerValue(res.phonemes))
+	}
+
+	body := res.audio
+	if wantTimings || wantMultipart {
+		meta := newSynthMetadata(voice, sr, res)
+		if wantMultipart {
+			body, err = multipartBody(key, audioType, meta, res.audio)
+		} else {
+			body, err = json.Marshal(meta)
+		}
+		if err != nil {
+			return err
+		}
+	}
 
-		if done := checkEtagDone(req, etag); done {
+	if *useEtag && *contentEtag {
+		sum := md5.Sum(body)
+		etag = hex.EncodeToString(sum[:])
+		resp.Header().Set("Etag", etag)
+		if checkNotModified(req, etag, time.Time{}) {
+			outcome = "not_modified"
 			resp.WriteHeader(http.StatusNotModified)
 			return nil
 		}
 	}
+	nbytes, err = resp.Write(body)
+	return err
+}
+
+// durationPollInterval is how often the length of the audio is checked against the maximum duration.
+const durationPollInterval = 100 * time.Millisecond
+
+// estimatedRate is the speech rate in words per minute assumed when estimating the duration of speech. It is faster
+// than most voices speak, so that only requests that are certainly too long are rejected.
+const estimatedRate = 250
+
+// estimateDuration estimates the duration of speech for text spoken at rate words per minute, or at estimatedRate
+// if rate is 0.
+func estimateDuration(text string, rate uint16) time.Duration {
+	wpm := float64(rate)
+	if wpm == 0 {
+		wpm = estimatedRate
+	}
+	return time.Duration(float64(len(strings.Fields(text))) / wpm * float64(time.Minute))
+}
+
+var errTooLong = &httpError{status: http.StatusRequestEntityTooLarge, err: errors.New("speech exceeds the maximum duration")}
+
+// watchDuration cancels synthesis once more than max of audio has been written to eaf, recording that in exceeded.
+// It returns when ctx is done. The frames written are counted at the sample rate of the client data format, which the
+// synthesizer sets to the voice's native rate once it starts writing, so the limit is derived from that rate.
+func watchDuration(ctx context.Context, cancel context.CancelFunc, eaf *mactts.ExtAudioFile, max time.Duration, exceeded *int32) {
+	t := time.NewTicker(durationPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			cf, err := eaf.ClientDataFormat()
+			if err != nil || cf.SampleRate == 0 {
+				continue
+			}
+			maxFrames := int64(max.Seconds() * cf.SampleRate)
+			if n, err := eaf.Tell(); err == nil && n > maxFrames {
+				atomic.StoreInt32(exceeded, 1)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// audioFileFunc opens an output file of a type such as WAVE, as mactts.NewOutputWAVEFile does.
+type audioFileFunc func(target mactts.ReadWriterAt, rate float64, numchan int, numbits int) (*mactts.AudioFile, error)
+
+// synthRequest holds the parameters of a speech synthesis.
+type synthRequest struct {
+	msg        string
+	voiceSpec  *mactts.VoiceSpec
+	sampleRate int
+	rate       uint16
+	pitch      float64
+	bitRate    int
+	newFile    audioFileFunc
+	timings    bool
+	phonemes   bool
+}
+
+// synthResult is the output of a speech synthesis.
+type synthResult struct {
+	audio      []byte              // the audio file
+	frames     int64               // length of the audio in sample frames at frameRate
+	frameRate  float64             // sample rate of the frames counted by the synthesizer, the voice's native rate
+	words      []mactts.WordTiming // positions of the words in the audio, if timings were requested
+	phonemes   string              // phonetic transcription of the text, if requested
+	firstAudio time.Duration       // time until the first audio was written, or 0 if unknown
+}
+
+// synthCalls coalesces concurrent identical synthesis requests.
+var synthCalls coalescer
+
+// sampleRates are the values of the samplerate parameter.
+var sampleRates = []int{8000, 11025, 16000, 22050, 32000, 44100, 48000}
+
+// nativeFormats caches the native format of each voice, which takes a synthesis to find.
+var nativeFormats struct {
+	sync.Mutex
+	m map[mactts.VoiceSpec]mactts.StreamFormat
+}
 
-	af, err := newFileFunc(f, float64(sampleRate), 1, 16)
+// nativeFormat returns the native format of the voice vs of the channel sc, which must not yet have an output file.
+func nativeFormat(ctx context.Context, sc *mactts.Channel, vs *mactts.VoiceSpec) (mactts.StreamFormat, error) {
+	nativeFormats.Lock()
+	f, ok := nativeFormats.m[*vs]
+	nativeFormats.Unlock()
+	if ok {
+		return f, nil
+	}
+	f, err := sc.NativeFormat(ctx)
 	if err != nil {
-		return err
+		return f, err
+	}
+	nativeFormats.Lock()
+	if nativeFormats.m == nil {
+		nativeFormats.m = make(map[mactts.VoiceSpec]mactts.StreamFormat)
+	}
+	nativeFormats.m[*vs] = f
+	nativeFormats.Unlock()
+	return f, nil
+}
+
+// supportedRates returns the sample rates of sampleRates at which files made by newFile can be written from audio in
+// the native format of a voice.
+func supportedRates(newFile audioFileFunc, native mactts.StreamFormat) []int {
+	var rates []int
+	for _, rate := range sampleRates {
+		var f ResponseBuffer
+		af, err := newFile(&f, float64(rate), 1, 16)
+		if err != nil {
+			continue
+		}
+		if eaf, err := af.ExtAudioFile(); err == nil {
+			if eaf.SetClientDataFormat(native) == nil {
+				rates = append(rates, rate)
+			}
+			eaf.Close()
+		}
+		af.Close()
+	}
+	return rates
+}
+
+// synthesize synthesizes speech for a request. ctx bounds the time spent waiting for a speech channel.
+func synthesize(ctx context.Context, sr *synthRequest) (*synthResult, error) {
+	var f ResponseBuffer
+	af, err := sr.newFile(&f, float64(sr.sampleRate), 1, 16)
+	if err != nil {
+		return nil, err
 	}
 	defer af.Close()
 
 	eaf, err := af.ExtAudioFile()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer eaf.Close()
 
-	sc, err := mactts.NewChannel(voiceSpec)
+	sc, err := mactts.NewChannelRetryContext(ctx, sr.voiceSpec, channelRetryBackoff)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer sc.Close()
 
-	if rate != 0 {
-		if err := sc.SetRate(int(rate)); err != nil {
-			return err
+	// a sample rate the file cannot be converted to from the voice's audio is rejected before synthesis, rather than
+	// producing empty audio. The client format is set before the bit rate, since setting it replaces the encoder.
+	native, err := nativeFormat(ctx, sc, sr.voiceSpec)
+	if err != nil {
+		return nil, err
+	}
+	if err = eaf.SetClientDataFormat(native); err != nil {
+		return nil, &httpError{status: http.StatusBadRequest, err: fmt.Errorf(
+			"the voice cannot produce audio at %d Hz from its native %g Hz; supported `samplerate` values are %v",
+			sr.sampleRate, native.SampleRate, supportedRates(sr.newFile, native))}
+	}
+
+	if sr.bitRate != 0 {
+		if err := eaf.SetBitRate(sr.bitRate); err != nil {
+			return nil, &httpError{status: http.StatusBadRequest, err: fmt.Errorf("unsupported `bitrate` parameter: %v", err)}
 		}
 	}
-	if pitch != 0.0 {
-		if err := sc.SetPitchBase(pitch); err != nil {
-			return err
+
+	if !*allowCommands {
+		if err := sc.DisableCommands(); err != nil {
+			return nil, err
+		}
+	}
+	if sr.rate != 0 {
+		if err := sc.SetRate(int(sr.rate)); err != nil {
+			return nil, err
+		}
+	}
+	if sr.pitch != 0.0 {
+		if err := sc.SetPitchBase(sr.pitch); err != nil {
+			return nil, err
 		}
 	}
 
 	if err = sc.SetExtAudioFile(eaf); err != nil {
-		return err
+		return nil, err
 	}
 
-	done := make(chan int)
-	err = sc.SetDone(func() {
-		done <- 1
-		close(done)
-	})
+	// the transcription is made by the same channel, so it reflects the voice and settings of the audio
+	var phonemes string
+	if sr.phonemes {
+		if phonemes, err = sc.TextToPhonemes(sr.msg); err != nil {
+			return nil, err
+		}
+	}
+
+	// synthesis is canceled by the timeout of ctx, or by the watcher when the audio exceeds the maximum duration
+	var exceeded int32
+	stopWatch := func() {}
+	if *maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		watched := make(chan struct{})
+		go func() {
+			watchDuration(ctx, cancel, eaf, *maxDuration, &exceeded)
+			close(watched)
+		}()
+		stopWatch = func() {
+			cancel()
+			<-watched
+		}
+		defer stopWatch()
+	}
+	canceled := func() error {
+		if atomic.LoadInt32(&exceeded) != 0 {
+			return errTooLong
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.New("timed out synthesizing speech")
+		}
+		return errors.New("synthesis canceled: every client waiting for it has gone away")
+	}
+
+	start := time.Now()
+	var words []mactts.WordTiming
+	if sr.timings {
+		words, err = sc.SpeakTimings(ctx, sr.msg, eaf)
+	} else {
+		err = sc.SpeakStringContext(ctx, sr.msg)
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, canceled()
+	} else if err != nil {
+		return nil, err
+	}
+	stopWatch()
+
+	if err = eaf.CheckAudio(); err == mactts.ErrNoAudio {
+		// a voice that cannot produce the requested sample rate may produce nothing at all
+		if cf, cerr := eaf.ClientDataFormat(); cerr == nil && cf.SampleRate != 0 && int(cf.SampleRate) != sr.sampleRate {
+			err = fmt.Errorf("%v at %d Hz; the native sample rate of the voice is %g Hz", err, sr.sampleRate, cf.SampleRate)
+		}
+		return nil, &httpError{status: http.StatusInternalServerError, err: err}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var res synthResult
+	synthStats.Add("requests", 1)
+	synthStats.Add("total_ms", int64(time.Since(start)/time.Millisecond))
+	if t := af.FirstWriteTime(); !t.IsZero() {
+		res.firstAudio = t.Sub(start)
+		synthStats.Add("first_audio_ms", int64(res.firstAudio/time.Millisecond))
+	}
+
+	res.words = words
+	res.phonemes = phonemes
+	if res.frames, err = eaf.Tell(); err != nil {
+		return nil, err
+	}
+	cf, err := eaf.ClientDataFormat()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	res.frameRate = cf.SampleRate
 
-	if err = sc.SpeakString(msg); err != nil {
-		return nil
+	// the file must be complete before its bytes are shared
+	sc.Close()
+	eaf.Close()
+	if err = af.Close(); err != nil {
+		return nil, err
+	}
+	res.audio = f.buf
+	return &res, nil
+}
+
+// sanitizeFilename removes the characters from name that could end the quoted filename of a Content-Disposition
+// header or inject another header.
+func sanitizeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\r', '\n', '"', '\\':
+			return -1
+		}
+		return r
+	}, name)
+}
+
+// headerValue makes s safe to use as an HTTP header value by replacing line breaks and other control characters
+// with spaces.
+func headerValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// wordTiming is the JSON representation of the position of a word in synthesized speech.
+type wordTiming struct {
+	Word       string `json:"word"`
+	Offset     int    `json:"offset"`
+	StartFrame int64  `json:"start_frame"`
+	EndFrame   int64  `json:"end_frame"`
+}
+
+// synthMetadata is the JSON description of synthesized speech, which is returned for timings and multipart requests.
+// Frame numbers can be converted to seconds by dividing by the sample rate.
+type synthMetadata struct {
+	Voice      string       `json:"voice"`
+	VoiceID    string       `json:"voice_id,omitempty"`
+	SampleRate int          `json:"sample_rate"`
+	Rate       int          `json:"rate,omitempty"`
+	DurationMs int64        `json:"duration_ms"`
+	Words      []wordTiming `json:"words"`
+	Phonemes   string       `json:"phonemes,omitempty"`
+}
+
+func newSynthMetadata(voice *Voice, sr *synthRequest, res *synthResult) *synthMetadata {
+	meta := &synthMetadata{
+		Voice:      voice.Name,
+		VoiceID:    voice.Identifier,
+		SampleRate: sr.sampleRate,
+		Rate:       int(sr.rate),
+		DurationMs: int64(res.seconds(res.frames) * 1000),
+		Words:      make([]wordTiming, len(res.words)),
+		Phonemes:   res.phonemes,
 	}
-	select {
-	case <-done:
-	case <-time.After(1 * time.Minute):
-		return errors.New("timed out synthesizing speech")
+	// the synthesizer counts frames at the voice's native rate, which are reported at the sample rate of the audio
+	rate := float64(sr.sampleRate)
+	for i, wt := range res.words {
+		meta.Words[i] = wordTiming{Word: wt.Word, Offset: wt.Offset,
+			StartFrame: int64(res.seconds(wt.StartFrame) * rate), EndFrame: int64(res.seconds(wt.EndFrame) * rate)}
 	}
-	return nil
+	return meta
+}
+
+// seconds converts a number of frames counted by the synthesizer to seconds.
+func (res *synthResult) seconds(frames int64) float64 {
+	if res.frameRate == 0 {
+		return 0
+	}
+	return float64(frames) / res.frameRate
+}
+
+// multipartBody returns a multipart/mixed body with the given boundary holding the metadata as JSON followed by the
+// audio.
+func multipartBody(boundary string, audioType string, meta *synthMetadata, audio []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {jsonMIMEType}})
+	if err != nil {
+		return nil, err
+	}
+	if err = json.NewEncoder(part).Encode(meta); err != nil {
+		return nil, err
+	}
+	if part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {audioType}}); err != nil {
+		return nil, err
+	}
+	if _, err = part.Write(audio); err != nil {
+		return nil, err
+	}
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // Voice is a representation of system voice metadata.
 type Voice struct {
-	spec       mactts.VoiceSpec
-	gender     mactts.Gender
-	Name       string `json:"name"`
-	Locale     string `json:"locale,omitempty"`
-	Gender     string `json:"gender"`
-	Age        int    `json:"age"`
-	Identifier string `json:"id,omitempty"`
+	spec        mactts.VoiceSpec
+	gender      mactts.Gender
+	Name        string `json:"name"`
+	Locale      string `json:"locale,omitempty"`
+	Gender      string `json:"gender"`
+	Age         int    `json:"age"`
+	Identifier  string `json:"id,omitempty"`
+	Synthesizer string `json:"synthesizer"`
+	Category    string `json:"category"`
 }
 
 // Spec returns the system VoiceSpec.
@@ -353,18 +856,78 @@ func (v *Voice) Spec() *mactts.VoiceSpec {
 type VoiceCollection struct {
 	voices      []Voice
 	voiceByName map[string]*Voice
-	json        []byte
+	voiceByID   map[string]*Voice
+
+	jsonOnce sync.Once // guards json and jsonErr, which cache the JSON encoding
+	json     []byte
+	jsonErr  error
 }
 
 func (vc *VoiceCollection) MarshalJSON() ([]byte, error) {
-	var err error
-	if len(vc.json) == 0 {
-		v := struct {
-			Voices []Voice `json:"voices"`
-		}{Voices: vc.voices}
-		vc.json, err = json.Marshal(&v)
+	vc.jsonOnce.Do(func() {
+		var buf bytes.Buffer
+		vc.jsonErr = vc.encodeJSON(&buf)
+		vc.json = buf.Bytes()
+	})
+	return vc.json, vc.jsonErr
+}
+
+// WriteJSON writes the JSON encoding of the collection to w, as returned by MarshalJSON. The first call writes the
+// voices to w one at a time as they are encoded, rather than building the whole document before writing it, keeping
+// a copy of the output to serve later calls.
+func (vc *VoiceCollection) WriteJSON(w io.Writer) error {
+	ew := &errWriter{w: w}
+	encoded := false
+	vc.jsonOnce.Do(func() {
+		encoded = true
+		var buf bytes.Buffer
+		vc.jsonErr = vc.encodeJSON(io.MultiWriter(&buf, ew))
+		vc.json = buf.Bytes()
+	})
+	if vc.jsonErr != nil {
+		return vc.jsonErr
+	}
+	if !encoded {
+		ew.Write(vc.json)
+	}
+	return ew.err
+}
+
+// encodeJSON writes the JSON encoding of the collection to w.
+func (vc *VoiceCollection) encodeJSON(w io.Writer) error {
+	if _, err := io.WriteString(w, `{"voices":[`); err != nil {
+		return err
+	}
+	for i := range vc.voices {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		b, err := json.Marshal(&vc.voices[i])
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(b); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]}")
+	return err
+}
+
+// errWriter writes to w until a write fails, and then discards further writes, keeping the error. It lets the
+// cached JSON of a VoiceCollection be completed even if the client it is being streamed to goes away.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	if ew.err == nil {
+		_, ew.err = ew.w.Write(p)
 	}
-	return vc.json, err
+	return len(p), nil
 }
 
 // Match finds a matching voice for a gender and a locale. locale may be empty, in which
@@ -382,71 +945,206 @@ func (vc *VoiceCollection) Match(gender mactts.Gender, locale string) *Voice {
 	return nil
 }
 
+// MatchLanguage finds a voice of a gender for text in the language of a BCP 47 language tag such as en-GB. A voice
+// for the exact locale is preferred, and then any voice for the primary language. The gender may be GenderNil, which
+// means that gender is ignored. MatchLanguage will return nil if no voice speaks the language.
+func (vc *VoiceCollection) MatchLanguage(gender mactts.Gender, tag string) *Voice {
+	if v := vc.Match(gender, strings.Replace(tag, "-", "_", -1)); v != nil {
+		return v
+	}
+	lang := primaryLanguage(tag)
+	for i := range vc.voices {
+		v := &vc.voices[i]
+		if (gender == mactts.GenderNil || gender == v.gender) && strings.EqualFold(primaryLanguage(v.Locale), lang) {
+			return v
+		}
+	}
+	return nil
+}
+
+// primaryLanguage returns the primary language subtag of a BCP 47 language tag or a locale identifier.
+func primaryLanguage(tag string) string {
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		return tag[:i]
+	}
+	return tag
+}
+
+// Category returns a collection of the voices in the collection with the given category, such as novelty.
+func (vc *VoiceCollection) Category(category string) *VoiceCollection {
+	c := &VoiceCollection{}
+	for _, v := range vc.voices {
+		if v.Category == category {
+			c.voices = append(c.voices, v)
+		}
+	}
+	return c
+}
+
 // FindByName finds a voice in the collection with the given system name.
 func (vc *VoiceCollection) FindByName(name string) *Voice {
 	return vc.voiceByName[name]
 }
 
+// FindByID finds a voice in the collection with the given system identifier, such as com.apple.speech.synthesis.voice.Fred.
+func (vc *VoiceCollection) FindByID(id string) *Voice {
+	return vc.voiceByID[id]
+}
+
 var voices VoiceCollection
 
+// fallbacks is the parsed list of voice names and locales from the -fallback flag.
+var fallbacks []string
+
+// fallbackVoice returns the first installed voice from the fallback list, where each entry is matched by name
+// and then by locale. fallbackVoice returns nil if none of them is installed.
+func fallbackVoice() *Voice {
+	for _, f := range fallbacks {
+		if v := voices.FindByName(f); v != nil {
+			return v
+		}
+		if v := voices.Match(mactts.GenderNil, f); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
 func loadVoices() error {
-	n, err := mactts.NumVoices()
+	specs, err := mactts.Voices()
 	if err != nil {
 		return err
 	}
-	vs := make([]Voice, n)
+	vs := make([]Voice, len(specs))
 	vsm := make(map[string]*Voice)
-	for i := 0; i < n; i++ {
-		v, err := mactts.GetVoice(i + 1)
-		if err != nil {
-			return err
-		}
-		desc, err := v.Description()
-		if err != nil {
-			return nil
-		}
-
-		var locale, identifier string
+	vsid := make(map[string]*Voice)
+	for i, v := range specs {
+		// the attributes have everything but are undocumented, so fall back to the description
+		var name, locale, identifier string
+		gender, age := mactts.GenderNil, 0
+		category := mactts.VoiceCategoryStandard
 		if attr, err := v.Attributes(); err == nil {
+			name = attr.Name()
 			locale = attr.LocaleIdentifier()
 			identifier = attr.Identifier()
+			gender = attr.Gender()
+			age = attr.Age()
+			category = attr.Category()
+		}
+		if name == "" || gender == mactts.GenderNil {
+			desc, err := v.Description()
+			if err != nil {
+				return err
+			}
+			name = desc.Name()
+			gender = desc.Gender()
+			age = desc.Age()
 		}
-		name := desc.Name()
+
 		vs[i] = Voice{
-			spec:       *v,
-			gender:     desc.Gender(),
-			Name:       name,
-			Locale:     locale,
-			Gender:     desc.Gender().String(),
-			Age:        desc.Age(),
-			Identifier: identifier,
+			spec:        *v,
+			gender:      gender,
+			Name:        name,
+			Locale:      locale,
+			Gender:      gender.String(),
+			Age:         age,
+			Identifier:  identifier,
+			Synthesizer: v.Synthesizer(),
+			Category:    category.String(),
 		}
 		vsm[name] = &vs[i]
+		if identifier != "" {
+			vsid[identifier] = &vs[i]
+		}
 	}
 	voices.voices = vs
 	voices.voiceByName = vsm
+	voices.voiceByID = vsid
 	return nil
 }
 
 func voicesHandler(resp http.ResponseWriter, req *http.Request) error {
 	resp.Header().Set("Content-Type", jsonMIMEType)
-	data, err := voices.MarshalJSON()
+	// the voices are written to the client as they are encoded rather than buffered
+	var w io.Writer = resp
+	if rb, ok := resp.(*ResponseBuffer); ok {
+		w = rb.Stream()
+	}
+	vc := &voices
+	if category := req.FormValue("category"); category != "" {
+		vc = voices.Category(category)
+	}
+	if err := vc.WriteJSON(w); err != nil {
+		// the response has already been started, so the error can only be logged
+		logError(req, err, nil)
+	}
+	return nil
+}
+
+// healthFailures counts consecutive failed health checks.
+var healthFailures int32
+
+func healthHandler(resp http.ResponseWriter, req *http.Request) error {
+	resp.Header().Set("Cache-Control", "no-cache")
+	if err := mactts.Probe(); err != nil {
+		n := atomic.AddInt32(&healthFailures, 1)
+		if *unhealthyExit > 0 && int(n) >= *unhealthyExit {
+			log.Fatalf("Synthesizer failed %d consecutive health checks: %v", n, err)
+		}
+		return &httpError{status: http.StatusServiceUnavailable, err: err}
+	}
+	atomic.StoreInt32(&healthFailures, 0)
+
+	bySynth, err := mactts.VoicesBySynthesizer()
 	if err != nil {
 		return err
 	}
-	_, err = resp.Write(data)
-	return err
+	health := struct {
+		Status       string        `json:"status"`
+		Synthesizers []synthesizer `json:"synthesizers"`
+	}{Status: "ok", Synthesizers: []synthesizer{}}
+	for creator, vs := range bySynth {
+		s := synthesizer{Creator: creator}
+		if s.Identifier, s.Version, err = mactts.SynthesizerInfo(vs[0]); err != nil {
+			return err
+		}
+		health.Synthesizers = append(health.Synthesizers, s)
+	}
+	sort.Slice(health.Synthesizers, func(i, j int) bool {
+		return health.Synthesizers[i].Creator < health.Synthesizers[j].Creator
+	})
+	resp.Header().Set("Content-Type", jsonMIMEType)
+	return json.NewEncoder(resp).Encode(&health)
+}
+
+// synthesizer identifies an installed speech synthesizer and its version, to help triage pronunciation bugs.
+type synthesizer struct {
+	Creator    string `json:"creator"`
+	Identifier string `json:"id,omitempty"`
+	Version    string `json:"version,omitempty"`
 }
 
 func main() {
 	flag.Parse()
 	log.Printf("Starting server, os.Args=%s", strings.Join(os.Args, " "))
 
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logThreshold = level
+
 	if err := loadVoices(); err != nil {
 		log.Fatal(err)
 	}
+	for _, f := range strings.Split(*fallbackVoices, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fallbacks = append(fallbacks, f)
+		}
+	}
 
 	http.Handle("/voices", apiHandler(voicesHandler))
 	http.Handle("/say", apiHandler(speechHandler))
+	http.Handle("/healthz", apiHandler(healthHandler))
 	log.Fatal(http.ListenAndServe(*httpAddr, nil))
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jkl1337/mactts"
+)
+
+// TestLastModifiedLocalTime checks that a Last-Modified time taken from the local clock, as synthModTime is, is sent
+// in GMT and matched by an If-Modified-Since echoing it on a server that is not running in UTC.
+func TestLastModifiedLocalTime(t *testing.T) {
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	time.Local = time.FixedZone("EST", -5*60*60)
+
+	modtime := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.Local)
+	lm := httpTime(modtime)
+	if want := "Fri, 01 Mar 2024 17:00:00 GMT"; lm != want {
+		t.Fatalf("httpTime(%v) = %q, want %q", modtime, lm, want)
+	}
+
+	req, _ := http.NewRequest("GET", "/say", nil)
+	req.Header.Set("If-Modified-Since", lm)
+	if !checkNotModified(req, "", modtime) {
+		t.Errorf("If-Modified-Since %q does not match modification time %v", lm, modtime)
+	}
+	req.Header.Set("If-Modified-Since", httpTime(modtime.Add(-time.Hour)))
+	if checkNotModified(req, "", modtime) {
+		t.Errorf("If-Modified-Since an hour before modification time %v matches", modtime)
+	}
+}
+
+func TestMatchLanguage(t *testing.T) {
+	vc := VoiceCollection{voices: []Voice{
+		{Name: "Alex", Locale: "en_US", gender: mactts.GenderMale},
+		{Name: "Daniel", Locale: "en_GB", gender: mactts.GenderMale},
+		{Name: "Amelie", Locale: "fr_CA", gender: mactts.GenderFemale},
+		{Name: "Thomas", Locale: "fr_FR", gender: mactts.GenderMale},
+	}}
+	tests := []struct {
+		gender mactts.Gender
+		tag    string
+		want   string
+	}{
+		{mactts.GenderNil, "en-GB", "Daniel"},
+		{mactts.GenderNil, "en", "Alex"},
+		{mactts.GenderNil, "fr-FR", "Thomas"},
+		{mactts.GenderFemale, "fr-FR", "Amelie"},
+		{mactts.GenderNil, "de-DE", ""},
+		{mactts.GenderFemale, "en-US", ""},
+	}
+	for _, tt := range tests {
+		var got string
+		if v := vc.MatchLanguage(tt.gender, tt.tag); v != nil {
+			got = v.Name
+		}
+		if got != tt.want {
+			t.Errorf("MatchLanguage(%v, %q) = %q, want %q", tt.gender, tt.tag, got, tt.want)
+		}
+	}
+}
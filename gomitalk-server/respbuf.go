@@ -10,10 +10,12 @@ import (
 // ReaderAt and WriterAt interfaces in addition to the http.ResponseWriter interface.
 // ReaderSeeker is implemented to allow byte serving.
 type ResponseBuffer struct {
-	buf    []byte
-	readOfs int
-	status int
-	header http.Header
+	buf      []byte
+	readOfs  int
+	status   int
+	header   http.Header
+	target   http.ResponseWriter // response returned by Stream
+	streamed bool
 }
 
 func (rb *ResponseBuffer) Read(data []byte) (n int, err error) {
@@ -42,6 +44,11 @@ func (rb *ResponseBuffer) Seek(offset int64, whence int) (int64, error) {
 	return int64(rb.readOfs), nil
 }
 
+// Len returns the number of bytes of content in the buffer.
+func (rb *ResponseBuffer) Len() int {
+	return len(rb.buf)
+}
+
 // grow grows the buffer to guarantee space for n more bytes, increasing the length to accomdate them
 func (rb *ResponseBuffer) grow(n int) int {
 	m := len(rb.buf)
@@ -79,8 +86,26 @@ func (rb *ResponseBuffer) CopyHeaders(w http.ResponseWriter) {
 	}
 }
 
+// Stream writes the headers set so far to the response the buffer was created for and returns that response, so that
+// a handler can write a large body directly instead of buffering it. Byte ranges cannot be served for a streamed
+// response, and WriteTo writes nothing afterwards.
+func (rb *ResponseBuffer) Stream() http.ResponseWriter {
+	rb.Header().Del("Accept-Ranges")
+	for k, v := range rb.header {
+		rb.target.Header()[k] = v
+	}
+	if rb.status != 0 {
+		rb.target.WriteHeader(rb.status)
+	}
+	rb.streamed = true
+	return rb.target
+}
+
 // WriteTo writes the buffered contents and all http header information to another http.ResponseWriter.
 func (rb *ResponseBuffer) WriteTo(w http.ResponseWriter) error {
+	if rb.streamed {
+		return nil
+	}
 	rb.CopyHeaders(w)
 	if len(rb.buf) > 0 {
 		if _, err := w.Write(rb.buf); err != nil {
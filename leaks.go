@@ -0,0 +1,31 @@
+package mactts
+
+import "sync/atomic"
+
+// Counts of the objects holding system resources that have been created and not yet closed or finalized.
+var liveChannels, liveAudioFiles, liveExtAudioFiles int64
+
+// leakHandler holds the function set with SetLeakHandler.
+var leakHandler atomic.Value
+
+// LiveCounts returns the number of Channel, AudioFile and ExtAudioFile objects that have been created and not yet
+// closed. Objects that are never closed hold system resources until they are finalized, so counts that keep growing
+// indicate a leak.
+func LiveCounts() (channels, audioFiles, extAudioFiles int64) {
+	return atomic.LoadInt64(&liveChannels), atomic.LoadInt64(&liveAudioFiles), atomic.LoadInt64(&liveExtAudioFiles)
+}
+
+// SetLeakHandler sets a function that is called when a finalizer has to release the resources of an object that was
+// never closed. kind is the name of the type of the object: "Channel", "AudioFile" or "ExtAudioFile". The function is
+// called on the finalizer goroutine, so it must not block. If h is nil, leaks are not reported.
+func SetLeakHandler(h func(kind string)) {
+	leakHandler.Store(h)
+}
+
+// leaked records that a finalizer released an object of the given kind that was counted in live.
+func leaked(kind string, live *int64) {
+	atomic.AddInt64(live, -1)
+	if h, _ := leakHandler.Load().(func(string)); h != nil {
+		h(kind)
+	}
+}
@@ -6,6 +6,7 @@ package mactts
 #cgo CFLAGS:  -I/System/Library/Frameworks/ApplicationServices.framework/Versions/A/Frameworks/SpeechSynthesis.framework/Versions/A/Headers/
 #cgo LDFLAGS: -framework ApplicationServices
 #include <SpeechSynthesis.h>
+#include <stdlib.h>
 
 enum {
   soVoiceAttributes = 'attr'
@@ -20,6 +21,10 @@ extern CFStringRef kSpeechVoiceLocaleIdentifier;
 
 extern void go_speechdone_cb(SpeechChannel csc, long refcon);
 extern void go_speechphoneme_cb(SpeechChannel csc, long refcon, short phonemeOpcode);
+extern void go_speechword_cb(SpeechChannel csc, long refcon, CFStringRef str, CFRange rng);
+extern void go_speecherror_cb(SpeechChannel csc, long refcon, OSErr theError, long bytePos);
+extern void go_speechsync_cb(SpeechChannel csc, long refcon, OSType syncMessage);
+extern void go_speechtextdone_cb(SpeechChannel csc, long refcon, void **nextBuf, unsigned long *byteLen, SInt32 *controlFlags);
 
 // cfstring_utf8_length returns the number of characters successfully converted to UTF-8 and
 // the bytes required to store them.
@@ -30,6 +35,18 @@ static inline CFIndex cfstring_utf8_length(CFStringRef str, CFIndex *need) {
   return CFStringGetBytes(str, rng, kCFStringEncodingUTF8, 0, 0, NULL, 0, need);
 }
 
+// mactts_script_charset looks up the IANA character set name of the Mac OS text encoding for a script code.
+static inline Boolean mactts_script_charset(short script, CFStringRef *name) {
+  *name = CFStringConvertEncodingToIANACharSetName((CFStringEncoding)script);
+  return *name != NULL;
+}
+
+// mactts_utf8_range converts a range of UTF-16 units in str to a range of UTF-8 bytes.
+static inline void mactts_utf8_range(CFStringRef str, CFRange rng, CFIndex *offset, CFIndex *length) {
+  CFStringGetBytes(str, CFRangeMake(0, rng.location), kCFStringEncodingUTF8, 0, 0, NULL, 0, offset);
+  CFStringGetBytes(str, rng, kCFStringEncodingUTF8, 0, 0, NULL, 0, length);
+}
+
 static inline OSErr mactts_set_property_float64(SpeechChannel chan, CFStringRef prop, double n) {
   CFNumberRef cfn = CFNumberCreate(NULL, kCFNumberFloat64Type, &n);
   OSErr ret = SetSpeechProperty(chan, prop, cfn);
@@ -37,6 +54,135 @@ static inline OSErr mactts_set_property_float64(SpeechChannel chan, CFStringRef
   return ret;
 }
 
+// mactts_get_current_voice reads the voice of a speech channel. The copied property value is released once the voice
+// spec has been read from it.
+static inline OSErr mactts_get_current_voice(SpeechChannel chan, VoiceSpec *vs) {
+  CFDictionaryRef dict = NULL;
+  OSType creator = 0, id = 0;
+  CFNumberRef n;
+
+  OSErr ret = CopySpeechProperty(chan, kSpeechCurrentVoiceProperty, (CFTypeRef *)&dict);
+  if (ret != 0) {
+    return ret;
+  }
+  if ((n = CFDictionaryGetValue(dict, kSpeechVoiceCreator)) != NULL) {
+    CFNumberGetValue(n, kCFNumberSInt32Type, &creator);
+  }
+  if ((n = CFDictionaryGetValue(dict, kSpeechVoiceID)) != NULL) {
+    CFNumberGetValue(n, kCFNumberSInt32Type, &id);
+  }
+  CFRelease(dict);
+  return MakeVoiceSpec(creator, id, vs);
+}
+
+// mactts_get_synth_info reads the identifier and version of the synthesizer of a speech channel. The strings belong
+// to the synthesizer info dictionary returned in *dict, which the caller must release once they have been read.
+static inline OSErr mactts_get_synth_info(SpeechChannel chan, CFDictionaryRef *dict, CFStringRef *ident, CFStringRef *version) {
+  OSErr ret = CopySpeechProperty(chan, kSpeechSynthesizerInfoProperty, (CFTypeRef *)dict);
+  if (ret != 0) {
+    return ret;
+  }
+  *ident = CFDictionaryGetValue(*dict, kSpeechSynthesizerInfoIdentifier);
+  *version = CFDictionaryGetValue(*dict, kSpeechSynthesizerInfoVersion);
+  return 0;
+}
+
+// mactts_cfstring_valid reports whether a CFString reference is non-NULL.
+static inline Boolean mactts_cfstring_valid(CFStringRef str) {
+  return str != NULL;
+}
+
+enum { mactts_kind_string, mactts_kind_number, mactts_kind_boolean, mactts_kind_other };
+
+// mactts_cf_kind classifies a property list value for conversion to Go.
+static inline int mactts_cf_kind(CFTypeRef v) {
+  CFTypeID t = CFGetTypeID(v);
+  if (t == CFStringGetTypeID()) {
+    return mactts_kind_string;
+  } else if (t == CFNumberGetTypeID()) {
+    return mactts_kind_number;
+  } else if (t == CFBooleanGetTypeID()) {
+    return mactts_kind_boolean;
+  }
+  return mactts_kind_other;
+}
+
+static inline double mactts_cfnumber_float64(CFNumberRef n) {
+  double d = 0;
+  CFNumberGetValue(n, kCFNumberFloat64Type, &d);
+  return d;
+}
+
+// mactts_cfstring_bytes converts str to the text encoding enc in a buffer that must be freed by the caller. The length
+// of the converted text is returned in *n.
+static inline void *mactts_cfstring_bytes(CFStringRef str, CFStringEncoding enc, CFIndex *n) {
+  CFRange rng = CFRangeMake(0, CFStringGetLength(str));
+  void *buf;
+
+  *n = 0;
+  CFStringGetBytes(str, rng, enc, '?', false, NULL, 0, n);
+  buf = malloc(*n > 0 ? *n : 1);
+  CFStringGetBytes(str, rng, enc, '?', false, (UInt8 *)buf, *n, n);
+  return buf;
+}
+
+// mactts_speak_flags speaks str with the options of SpeakCFString that correspond to the SpeakBuffer control flags.
+static inline OSErr mactts_speak_flags(SpeechChannel chan, CFStringRef str, SInt32 flags) {
+  CFMutableDictionaryRef opts = CFDictionaryCreateMutable(NULL, 0, &kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+  OSErr ret;
+
+  if (flags & kNoEndingProsody)
+    CFDictionarySetValue(opts, kSpeechNoEndingProsody, kCFBooleanTrue);
+  if (flags & kNoSpeechInterrupt)
+    CFDictionarySetValue(opts, kSpeechNoSpeechInterrupt, kCFBooleanTrue);
+  if (flags & kPreflightThenPause)
+    CFDictionarySetValue(opts, kSpeechPreflightThenPause, kCFBooleanTrue);
+  ret = SpeakCFString(chan, str, opts);
+  CFRelease(opts);
+  return ret;
+}
+
+// mactts_get_property_float64 reads a numeric speech property. The copied property value is released once the number
+// has been read from it.
+static inline OSErr mactts_get_property_float64(SpeechChannel chan, CFStringRef prop, double *n) {
+  CFTypeRef v = NULL;
+  OSErr ret = CopySpeechProperty(chan, prop, &v);
+  if (ret != 0)
+    return ret;
+  if (v == NULL)
+    return paramErr;
+  if (CFGetTypeID(v) != CFNumberGetTypeID()) {
+    CFRelease(v);
+    return paramErr;
+  }
+  CFNumberGetValue((CFNumberRef)v, kCFNumberFloat64Type, n);
+  CFRelease(v);
+  return 0;
+}
+
+// mactts_use_dictionary installs a dictionary resource on a speech channel. The synthesizer copies the dictionary, so
+// the handle holding it is disposed of again.
+static inline OSErr mactts_use_dictionary(SpeechChannel chan, const void *data, long n) {
+  Handle h = NULL;
+  OSErr ret = PtrToHand(data, &h, n);
+  if (ret != 0)
+    return ret;
+  ret = UseDictionary(chan, h);
+  DisposeHandle(h);
+  return ret;
+}
+
+static inline OSErr mactts_set_command_delimiters(SpeechChannel chan, CFStringRef prefix, CFStringRef suffix) {
+  CFMutableDictionaryRef dict = CFDictionaryCreateMutable(NULL, 0, &kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+  OSErr ret;
+
+  CFDictionarySetValue(dict, kSpeechCommandPrefix, prefix);
+  CFDictionarySetValue(dict, kSpeechCommandSuffix, suffix);
+  ret = SetSpeechProperty(chan, kSpeechCommandDelimiterProperty, dict);
+  CFRelease(dict);
+  return ret;
+}
+
 static inline OSErr mactts_set_property_ptr(SpeechChannel chan, CFStringRef prop, void *p) {
   CFNumberRef cfn = CFNumberCreate(NULL, kCFNumberLongType, &p);
   OSErr ret = SetSpeechProperty(chan, prop, cfn);
@@ -47,14 +193,23 @@ static inline OSErr mactts_set_property_ptr(SpeechChannel chan, CFStringRef prop
 */
 import "C"
 import "runtime"
+import "context"
 import "errors"
 import "fmt"
 import "unsafe"
 import "reflect"
+import "strconv"
+import "strings"
+import "unicode/utf8"
+import "sync/atomic"
 import "encoding/binary"
+import "time"
 
 //export go_speechdone_cb
 func go_speechdone_cb(csc C.SpeechChannel, refcon C.long) {
+	if refcon == 0 {
+		return
+	}
 	c := (*Channel)(unsafe.Pointer(uintptr(refcon)))
 	if c.done != nil {
 		c.done()
@@ -63,12 +218,77 @@ func go_speechdone_cb(csc C.SpeechChannel, refcon C.long) {
 
 //export go_speechphoneme_cb
 func go_speechphoneme_cb(csc C.SpeechChannel, refcon C.long, phonemeOpcode C.short) {
+	if refcon == 0 {
+		return
+	}
 	c := (*Channel)(unsafe.Pointer(uintptr(refcon)))
 	if c.phonemeCb != nil {
 		c.phonemeCb(PhonemeCode(phonemeOpcode))
 	}
 }
 
+//export go_speechword_cb
+func go_speechword_cb(csc C.SpeechChannel, refcon C.long, str C.CFStringRef, rng C.CFRange) {
+	if refcon == 0 {
+		return
+	}
+	c := (*Channel)(unsafe.Pointer(uintptr(refcon)))
+	if c.wordCb != nil {
+		var offset, length C.CFIndex
+		C.mactts_utf8_range(str, rng, &offset, &length)
+		c.wordCb(int(offset), int(length))
+	}
+}
+
+//export go_speecherror_cb
+func go_speecherror_cb(csc C.SpeechChannel, refcon C.long, theError C.OSErr, bytePos C.long) {
+	if refcon == 0 {
+		return
+	}
+	c := (*Channel)(unsafe.Pointer(uintptr(refcon)))
+	if c.errorCb != nil {
+		c.errorCb(osError(theError), int(bytePos))
+	}
+}
+
+//export go_speechsync_cb
+func go_speechsync_cb(csc C.SpeechChannel, refcon C.long, syncMessage C.OSType) {
+	if refcon == 0 {
+		return
+	}
+	c := (*Channel)(unsafe.Pointer(uintptr(refcon)))
+	if c.syncCb != nil {
+		c.syncCb(int32(syncMessage))
+	}
+}
+
+//export go_speechtextdone_cb
+func go_speechtextdone_cb(csc C.SpeechChannel, refcon C.long, nextBuf *unsafe.Pointer, byteLen *C.ulong, controlFlags *C.SInt32) {
+	*nextBuf = nil
+	*byteLen = 0
+	*controlFlags = 0
+	if refcon == 0 {
+		return
+	}
+	c := (*Channel)(unsafe.Pointer(uintptr(refcon)))
+	if c.textDoneCb == nil {
+		return
+	}
+	// the synthesizer has finished with any earlier continuation text by the time it asks for more
+	freeBuffer(c.textDoneBuf)
+	c.textDoneBuf = nil
+	text, ok := c.textDoneCb()
+	if !ok {
+		return
+	}
+	cfs := cfstring(text)
+	defer C.CFRelease(C.CFTypeRef(cfs))
+	var n C.CFIndex
+	c.textDoneBuf = C.mactts_cfstring_bytes(cfs, c.textDoneEnc, &n)
+	*nextBuf = c.textDoneBuf
+	*byteLen = C.ulong(n)
+}
+
 // VoiceSpec uniquely identifies a speech synthesizer voice on the system.
 type VoiceSpec C.VoiceSpec
 
@@ -95,7 +315,14 @@ func (vs VoiceSpec) Id() uint32 {
 	return uint32(vs.id)
 }
 
-// MarshalBinary encodes the VoiceSpec to binary form and returns the result. It never returns an error.
+// Synthesizer returns the synthesizer creator code for the voice as a four character string.
+func (vs VoiceSpec) Synthesizer() string {
+	return osTypeToString(vs.creator)
+}
+
+// MarshalBinary encodes the VoiceSpec to binary form, the creator and id in big endian byte order, and returns the
+// result. It never returns an error. The encoding is stable, so it can be stored and used as a cache key across
+// restarts.
 func (vs VoiceSpec) MarshalBinary() (data []byte, err error) {
 	data = make([]byte, 8)
 	binary.BigEndian.PutUint32(data, uint32(vs.creator))
@@ -103,16 +330,67 @@ func (vs VoiceSpec) MarshalBinary() (data []byte, err error) {
 	return
 }
 
+// Equal reports whether other specifies the same voice as vs.
+func (vs VoiceSpec) Equal(other *VoiceSpec) bool {
+	return other != nil && vs.creator == other.creator && vs.id == other.id
+}
+
+// Key returns a string that identifies the voice, for use as a map key. Like MarshalBinary, it is stable across
+// restarts: it is the hexadecimal encoding of the creator and id.
+func (vs VoiceSpec) Key() string {
+	return fmt.Sprintf("%08x%08x", uint32(vs.creator), uint32(vs.id))
+}
+
+var errVoiceSpecLength = errors.New("binary VoiceSpec must be 8 bytes long")
+
+// UnmarshalBinary decodes a VoiceSpec encoded by MarshalBinary.
+func (vs *VoiceSpec) UnmarshalBinary(data []byte) error {
+	if len(data) != 8 {
+		return errVoiceSpecLength
+	}
+	vs.creator = C.OSType(binary.BigEndian.Uint32(data))
+	vs.id = C.OSType(binary.BigEndian.Uint32(data[4:]))
+	return nil
+}
+
+// TextEncoding returns the IANA character set name of the text encoding the voice expects, as determined by the
+// voice's script code. The empty string is returned if the encoding cannot be determined.
+//
+// Text passed to SpeakString is converted by the synthesizer, so characters with no representation in this encoding
+// are likely to be skipped or mispronounced.
+func (vs VoiceSpec) TextEncoding() string {
+	vd, err := vs.Description()
+	if err != nil {
+		return ""
+	}
+	var name C.CFStringRef
+	if C.mactts_script_charset(C.short(vd.script), &name) == 0 {
+		return ""
+	}
+	return cfstringGo(name)
+}
+
 // Channel is a independent channel resource for speech synthesis within the synthesizer.
 //
 // There is no predefined limit on the number of speech channels an application can create. However, system constraints on
 // available RAM, processor loading, and number of available sound channels limit the number of speech channels actually possible.
 type Channel struct {
-	csc  C.SpeechChannel
-	done func()
-	phonemeCb func(PhonemeCode)
+	csc         C.SpeechChannel
+	done        func()
+	phonemeCb   func(PhonemeCode)
+	wordCb      func(offset, length int)
+	syncCb      func(int32)
+	errorCb     func(error, int)
+	textDoneCb  func() (string, bool)
+	textDoneBuf unsafe.Pointer     // continuation text returned by textDoneCb
+	textDoneEnc C.CFStringEncoding // encoding of the continuation text, the text encoding of the voice
+	defaultRate C.Fixed
+	pcmOut      *pcmOutput
 }
 
+// errBadPhonemeText is the error code for invalid phoneme input.
+const errBadPhonemeText = -247
+
 var osErrorMap = map[int]error{
 	-240: errors.New("could not find the specified speech synthesizer"),
 	-241: errors.New("could not open another speech synthesizer channel"),
@@ -192,6 +470,110 @@ func NumVoices() (int, error) {
 	return int(cn), nil
 }
 
+// Voices returns all the voices available on the system, in the order of their indexes for GetVoice.
+func Voices() ([]*VoiceSpec, error) {
+	n, err := NumVoices()
+	if err != nil {
+		return nil, err
+	}
+	voices := make([]*VoiceSpec, 0, n)
+	for i := 1; i <= n; i++ {
+		vs, err := GetVoice(i)
+		if err != nil {
+			return nil, err
+		}
+		if vs != nil {
+			voices = append(voices, vs)
+		}
+	}
+	return voices, nil
+}
+
+// VoicesBySynthesizer returns all the voices available on the system grouped by the creator code of the
+// synthesizer that provides them, as returned by VoiceSpec.Synthesizer.
+func VoicesBySynthesizer() (map[string][]*VoiceSpec, error) {
+	voices, err := Voices()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][]*VoiceSpec)
+	for _, vs := range voices {
+		synth := vs.Synthesizer()
+		m[synth] = append(m[synth], vs)
+	}
+	return m, nil
+}
+
+// FindVoiceByIdentifier returns the voice with the given system identifier, such as
+// com.apple.speech.synthesis.voice.Fred, or nil if no such voice is installed. The attributes of each voice are only
+// fetched until a match is found, which makes it cheaper than enumerating all voices to check for one.
+func FindVoiceByIdentifier(id string) (*VoiceSpec, error) {
+	voices, err := Voices()
+	if err != nil {
+		return nil, err
+	}
+	for _, vs := range voices {
+		attr, err := vs.Attributes()
+		if err != nil {
+			continue
+		}
+		if attr.Identifier() == id {
+			return vs, nil
+		}
+	}
+	return nil, nil
+}
+
+// voiceTraits returns the name, locale and gender of a voice, preferring the voice attributes to the description.
+func voiceTraits(vs *VoiceSpec) (name, locale string, gender Gender, ok bool) {
+	gender = GenderNil
+	if attr, err := vs.Attributes(); err == nil {
+		name, locale, gender = attr.Name(), attr.LocaleIdentifier(), attr.Gender()
+	}
+	if name == "" || gender == GenderNil {
+		desc, err := vs.Description()
+		if err != nil {
+			return
+		}
+		name, gender = desc.Name(), desc.Gender()
+	}
+	return name, locale, gender, true
+}
+
+// baseVoiceName returns the name of a voice without a parenthesized variant such as "(Enhanced)".
+func baseVoiceName(name string) string {
+	if i := strings.IndexByte(name, '('); i > 0 {
+		name = name[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// VoicesSimilar reports whether two voices appear to be variants of the same voice, such as "Samantha" and
+// "Samantha (Enhanced)", so that a voice picker can group them. It is a heuristic: the voices are similar if their
+// names are the same apart from a parenthesized suffix, or one name is the other followed by more words, and their
+// locales and genders are the same where known.
+func VoicesSimilar(a, b *VoiceSpec) bool {
+	aName, aLocale, aGender, ok := voiceTraits(a)
+	if !ok {
+		return false
+	}
+	bName, bLocale, bGender, ok := voiceTraits(b)
+	if !ok {
+		return false
+	}
+	if aLocale != "" && bLocale != "" && aLocale != bLocale {
+		return false
+	}
+	if aGender != GenderNil && bGender != GenderNil && aGender != bGender {
+		return false
+	}
+	aName, bName = baseVoiceName(aName), baseVoiceName(bName)
+	if len(aName) > len(bName) {
+		aName, bName = bName, aName
+	}
+	return aName != "" && (aName == bName || strings.HasPrefix(bName, aName+" "))
+}
+
 // Gender is used to indicate the gender of the individual represented by a voice.
 type Gender int
 
@@ -267,6 +649,14 @@ func (d VoiceAttributes) get(k C.CFStringRef) (s string) {
 	return
 }
 
+func (d VoiceAttributes) getNumber(k C.CFStringRef) (float64, bool) {
+	v := C.CFDictionaryGetValue(d.cfd, unsafe.Pointer(k))
+	if v == nil || C.mactts_cf_kind(C.CFTypeRef(v)) != C.mactts_kind_number {
+		return 0, false
+	}
+	return float64(C.mactts_cfnumber_float64(C.CFNumberRef(v))), true
+}
+
 // Name is the short name of the voice as listed in the Speech Manager.
 func (d VoiceAttributes) Name() string {
 	return d.get(C.kSpeechVoiceName)
@@ -282,11 +672,111 @@ func (d VoiceAttributes) LocaleIdentifier() string {
 	return d.get(C.kSpeechVoiceLocaleIdentifier)
 }
 
+// Gender is the gender of the individual represented by the voice, or GenderNil if it is not known. The gender is
+// stored either as a Speech Manager gender number or as a string such as VoiceGenderFemale.
+func (d VoiceAttributes) Gender() Gender {
+	if n, ok := d.getNumber(C.kSpeechVoiceGender); ok {
+		return Gender(n)
+	}
+	switch d.get(C.kSpeechVoiceGender) {
+	case "VoiceGenderMale":
+		return GenderMale
+	case "VoiceGenderFemale":
+		return GenderFemale
+	case "VoiceGenderNeuter":
+		return GenderNeuter
+	}
+	return GenderNil
+}
+
+// Age is the approximate age in years of the individual represented by the voice, or 0 if it is not known.
+func (d VoiceAttributes) Age() int {
+	n, _ := d.getNumber(C.kSpeechVoiceAge)
+	return int(n)
+}
+
+// VoiceCategory groups voices by how they are offered in the system voice lists.
+type VoiceCategory int
+
+const (
+	// VoiceCategoryStandard voices are offered in every voice list.
+	VoiceCategoryStandard VoiceCategory = iota
+	// VoiceCategoryNovelty voices, such as Bells and Cellos, are only offered in the full list of voices.
+	VoiceCategoryNovelty
+)
+
+func (c VoiceCategory) String() string {
+	switch c {
+	case VoiceCategoryStandard:
+		return "standard"
+	case VoiceCategoryNovelty:
+		return "novelty"
+	}
+	return "(invalid)"
+}
+
+// Category is the category of the voice, read from the undocumented VoiceShowInFullListOnly attribute that marks the
+// novelty voices. Voices without the attribute are standard voices.
+func (d VoiceAttributes) Category() VoiceCategory {
+	k := cfstring("VoiceShowInFullListOnly")
+	defer C.CFRelease(C.CFTypeRef(k))
+	v := C.CFTypeRef(C.CFDictionaryGetValue(d.cfd, unsafe.Pointer(k)))
+	if v == nil {
+		return VoiceCategoryStandard
+	}
+	switch C.mactts_cf_kind(v) {
+	case C.mactts_kind_boolean:
+		if C.CFBooleanGetValue(C.CFBooleanRef(v)) != 0 {
+			return VoiceCategoryNovelty
+		}
+	case C.mactts_kind_number:
+		if C.mactts_cfnumber_float64(C.CFNumberRef(v)) != 0 {
+			return VoiceCategoryNovelty
+		}
+	}
+	return VoiceCategoryStandard
+}
+
 // DemoText is additional text information about the voice. Some synthesizers use this field to store an example phrase that can be spoken.
 func (d VoiceAttributes) DemoText() string {
 	return d.get(C.kSpeechVoiceDemoText)
 }
 
+// Snapshot copies all the attributes into a map, so they can be kept without keeping the CoreFoundation dictionary
+// alive. Numbers and booleans are formatted as strings, and any other values as their CoreFoundation description.
+// Attributes with keys that are not strings are omitted.
+func (d VoiceAttributes) Snapshot() map[string]string {
+	n := int(C.CFDictionaryGetCount(d.cfd))
+	m := make(map[string]string, n)
+	if n == 0 {
+		return m
+	}
+	keys := make([]unsafe.Pointer, n)
+	vals := make([]unsafe.Pointer, n)
+	C.CFDictionaryGetKeysAndValues(d.cfd, &keys[0], &vals[0])
+	for i := range keys {
+		if C.mactts_cf_kind(C.CFTypeRef(keys[i])) != C.mactts_kind_string {
+			continue
+		}
+		v := C.CFTypeRef(vals[i])
+		var s string
+		switch C.mactts_cf_kind(v) {
+		case C.mactts_kind_string:
+			s = cfstringGo(C.CFStringRef(vals[i]))
+		case C.mactts_kind_number:
+			s = strconv.FormatFloat(float64(C.mactts_cfnumber_float64(C.CFNumberRef(vals[i]))), 'f', -1, 64)
+		case C.mactts_kind_boolean:
+			s = strconv.FormatBool(C.CFBooleanGetValue(C.CFBooleanRef(vals[i])) != 0)
+		default:
+			desc := C.CFCopyDescription(v)
+			s = cfstringGo(desc)
+			C.CFRelease(C.CFTypeRef(desc))
+		}
+		m[cfstringGo(C.CFStringRef(keys[i]))] = s
+	}
+	return m
+}
+
 // Attributes provides metadata about the voice.
 // The attributes for a voice are described in the documentation for [NSSpeechSynthesizer attributesForVoice].
 // This functionality is undocumented in the Carbon Speech Synthesis Manager.
@@ -302,12 +792,71 @@ func (vs VoiceSpec) Attributes() (VoiceAttributes, error) {
 	return va, nil
 }
 
+// VoiceInfo is the metadata of a voice from both its description and its attributes.
+type VoiceInfo struct {
+	Name       string
+	Identifier string // system identifier, such as com.apple.speech.synthesis.voice.Fred
+	Locale     string // locale identifier, such as en_US
+	Gender     Gender
+	Age        int
+	Category   VoiceCategory
+	Version    int
+	Comment    string
+	DemoText   string
+}
+
+// Info returns the metadata of the voice. The attributes have everything but the version and comment, but are
+// undocumented, so where they lack a value it is taken from the description. Since the version and comment are only
+// in the description, Info always reads both; to read many voices quickly, use Attributes alone. An error is only
+// returned if neither can be read.
+func (vs VoiceSpec) Info() (VoiceInfo, error) {
+	info := VoiceInfo{Gender: GenderNil}
+	attr, aerr := vs.Attributes()
+	if aerr == nil {
+		info.Name = attr.Name()
+		info.Identifier = attr.Identifier()
+		info.Locale = attr.LocaleIdentifier()
+		info.Gender = attr.Gender()
+		info.Age = attr.Age()
+		info.Category = attr.Category()
+		info.DemoText = attr.DemoText()
+	}
+	vd, derr := vs.Description()
+	if derr != nil {
+		if aerr != nil {
+			return info, aerr
+		}
+		return info, nil
+	}
+	info.Version = vd.Version()
+	info.Comment = vd.Comment()
+	if info.Name == "" {
+		info.Name = vd.Name()
+	}
+	if info.Gender == GenderNil {
+		info.Gender = vd.Gender()
+	}
+	if info.Age == 0 {
+		info.Age = vd.Age()
+	}
+	return info, nil
+}
+
+func finalizeChannel(c *Channel) {
+	if c.csc != nil {
+		leaked("Channel", &liveChannels)
+	}
+	disposeSpeechChannel(c)
+}
+
 func disposeSpeechChannel(c *Channel) {
 	if c.csc == nil { return }
 
 	c.SetExtAudioFile(nil)
 	C.DisposeSpeechChannel(c.csc)
 	c.csc = nil
+	freeBuffer(c.textDoneBuf)
+	c.textDoneBuf = nil
 }
 
 // NewChannel creates a speech synthesizer speech channel with option voice specification. If no voice is provided, the system voice is used.
@@ -326,13 +875,55 @@ func NewChannel(voice *VoiceSpec) (*Channel, error) {
 		return nil, osError(oserr)
 	}
 
-	runtime.SetFinalizer(&c, disposeSpeechChannel)
+	// remember the voice's default rate for SetRateMultiplier
+	C.GetSpeechRate(c.csc, &c.defaultRate)
+
+	atomic.AddInt64(&liveChannels, 1)
+	runtime.SetFinalizer(&c, finalizeChannel)
+	return &c, nil
+}
+
+// NewQueryChannel creates a speech channel like NewChannel, but without the setup needed to deliver callbacks to Go,
+// which leaves one less step that can fail. It is meant for channels that are only used to query the synthesizer or
+// voice, and callbacks set on it are never called.
+func NewQueryChannel(voice *VoiceSpec) (*Channel, error) {
+	var c Channel
+
+	oserr := C.NewSpeechChannel((*C.VoiceSpec)(voice), &c.csc)
+	if oserr != 0 {
+		return nil, osError(oserr)
+	}
+	atomic.AddInt64(&liveChannels, 1)
+	runtime.SetFinalizer(&c, finalizeChannel)
 	return &c, nil
 }
 
-// SetDone sets a synthesis completion callback function for the speech channel.
+// NewChannelRetryContext is like NewChannel, but if the synthesizer cannot open another channel it retries every backoff
+// interval until a channel becomes available or ctx is done. In the latter case ctx.Err() is returned.
+func NewChannelRetryContext(ctx context.Context, voice *VoiceSpec, backoff time.Duration) (*Channel, error) {
+	for {
+		c, err := NewChannel(voice)
+		if err != osErrorMap[C.synthOpenFailed] {
+			return c, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// SetDone sets a synthesis completion callback function for the speech channel. If done is nil, any callback
+// previously set is removed.
+//
+// done is called on a synthesizer thread and must not block, or synthesis on the channel stalls. To signal a waiting
+// goroutine, send on a buffered channel with a select statement that has a default case.
 func (c *Channel) SetDone(done func()) error {
-	cbp := C.go_speechdone_cb
+	var cbp unsafe.Pointer
+	if done != nil {
+		cbp = C.go_speechdone_cb
+	}
 	oserr := C.mactts_set_property_ptr(c.csc, C.kSpeechSpeechDoneCallBack, cbp)
 	if oserr != 0 {
 		return osError(oserr)
@@ -341,9 +932,13 @@ func (c *Channel) SetDone(done func()) error {
 	return nil
 }
 
-// SetPhonemeCb sets a callback function invoked before each phoneme is synthesized.
+// SetPhonemeCb sets a callback function invoked before each phoneme is synthesized. If phonemeCb is nil, any callback
+// previously set is removed.
 func (c *Channel) SetPhonemeCb(phonemeCb func(PhonemeCode)) error {
-	cbp := C.go_speechphoneme_cb
+	var cbp unsafe.Pointer
+	if phonemeCb != nil {
+		cbp = C.go_speechphoneme_cb
+	}
 	oserr := C.mactts_set_property_ptr(c.csc, C.kSpeechPhonemeCallBack, cbp)
 	if oserr != 0 {
 		return osError(oserr)
@@ -352,6 +947,109 @@ func (c *Channel) SetPhonemeCb(phonemeCb func(PhonemeCode)) error {
 	return nil
 }
 
+// SetPhonemeCallback is like SetPhonemeCb, but reports the opcode of each phoneme as a uint16.
+//
+// phonemeCb is called on a synthesizer thread and, like the done callback, must not block.
+func (c *Channel) SetPhonemeCallback(phonemeCb func(phonemeOpcode uint16)) error {
+	if phonemeCb == nil {
+		return c.SetPhonemeCb(nil)
+	}
+	return c.SetPhonemeCb(func(p PhonemeCode) {
+		phonemeCb(uint16(p))
+	})
+}
+
+// setWordCb sets a callback function invoked with the byte offset and length of each word in the text as the
+// synthesizer reaches it. If wordCb is nil, any callback previously set is removed.
+func (c *Channel) setWordCb(wordCb func(offset, length int)) error {
+	var cbp unsafe.Pointer
+	if wordCb != nil {
+		cbp = C.go_speechword_cb
+	}
+	oserr := C.mactts_set_property_ptr(c.csc, C.kSpeechWordCFCallBack, cbp)
+	if oserr != 0 {
+		return osError(oserr)
+	}
+	c.wordCb = wordCb
+	return nil
+}
+
+// SetWordCallback sets a callback function invoked as the synthesizer reaches each word of the text, with the byte
+// offset and length of the word in the UTF-8 text passed to SpeakString. If wordCb is nil, any callback previously
+// set is removed.
+//
+// wordCb is called on a synthesizer thread and, like the done callback, must not block.
+func (c *Channel) SetWordCallback(wordCb func(byteOffset, byteLength uint32)) error {
+	if wordCb == nil {
+		return c.setWordCb(nil)
+	}
+	return c.setWordCb(func(offset, length int) {
+		wordCb(uint32(offset), uint32(length))
+	})
+}
+
+// SetErrorCallback sets a callback function invoked when the synthesizer encounters an error while speaking, such as
+// an invalid embedded command, with the error and the offset in the text where it occurred. If errorCb is nil, any
+// callback previously set is removed.
+//
+// errorCb is called on a synthesizer thread and, like the done callback, must not block.
+func (c *Channel) SetErrorCallback(errorCb func(oserr error, textOffset int)) error {
+	var cbp unsafe.Pointer
+	if errorCb != nil {
+		cbp = C.go_speecherror_cb
+	}
+	oserr := C.mactts_set_property_ptr(c.csc, C.kSpeechErrorCallBack, cbp)
+	if oserr != 0 {
+		return osError(oserr)
+	}
+	c.errorCb = errorCb
+	return nil
+}
+
+// SetSyncCallback sets a callback function invoked when the synthesizer reaches a synchronization command embedded in
+// the text, such as [[sync 0x1A2B3C4D]], with the message of the command. If syncCb is nil, any callback previously
+// set is removed.
+//
+// syncCb is called on a synthesizer thread and, like the done callback, must not block.
+func (c *Channel) SetSyncCallback(syncCb func(syncMessage int32)) error {
+	var cbp unsafe.Pointer
+	if syncCb != nil {
+		cbp = C.go_speechsync_cb
+	}
+	oserr := C.mactts_set_property_ptr(c.csc, C.kSpeechSyncCallBack, cbp)
+	if oserr != 0 {
+		return osError(oserr)
+	}
+	c.syncCb = syncCb
+	return nil
+}
+
+// SetTextDoneCallback sets a callback function invoked when the synthesizer has consumed the text it was given, before
+// the text has been spoken. If textDoneCb returns ok, nextText is spoken as a continuation of the text, without the
+// pause there would be between two calls to SpeakString. If textDoneCb is nil, any callback previously set is removed.
+// nextText is passed to the synthesizer in the text encoding of the voice, which is looked up when the callback is set
+// and again when SetVoice changes the voice.
+//
+// textDoneCb is called on a synthesizer thread and, like the done callback, must not block.
+func (c *Channel) SetTextDoneCallback(textDoneCb func() (nextText string, ok bool)) error {
+	var cbp unsafe.Pointer
+	if textDoneCb != nil {
+		// the encoding is looked up here rather than on the synthesizer thread, where an error could not be reported
+		enc, err := c.textEncoding()
+		if err != nil {
+			return err
+		}
+		c.textDoneEnc = enc
+		cbp = C.go_speechtextdone_cb
+	}
+	oserr := C.mactts_set_property_ptr(c.csc, C.kSpeechTextDoneCallBack, cbp)
+	if oserr != 0 {
+		return osError(oserr)
+	}
+	c.textDoneCb = textDoneCb
+	return nil
+}
+
 // SpeakString asynchronously queues the string for synthesis by the channel.
 func (c *Channel) SpeakString(s string) error {
 	cfs := cfstring(s)
@@ -359,6 +1057,80 @@ func (c *Channel) SpeakString(s string) error {
 	return osError(C.SpeakCFString(c.csc, cfs, nil))
 }
 
+// speechErrors returns the number of synthesis errors since speechErrors was last called, and the most recent error
+// and its position in the text.
+func (c *Channel) speechErrors() (count int, newest int, newPos int, err error) {
+	var info C.SpeechErrorInfo
+	if err = osError(C.GetSpeechInfo(c.csc, C.soErrors, unsafe.Pointer(&info))); err != nil {
+		return
+	}
+	return int(info.count), int(info.newest), int(info.newPos), nil
+}
+
+// SpeakFlags control how SpeakBuffer speaks text.
+type SpeakFlags C.SInt32
+
+const (
+	// SpeakNoEndingProsody suppresses the falling pitch that normally ends an utterance, so that the next text spoken
+	// continues it.
+	SpeakNoEndingProsody SpeakFlags = C.kNoEndingProsody
+	// SpeakNoSpeechInterrupt makes SpeakBuffer return an error instead of interrupting speech in progress.
+	SpeakNoSpeechInterrupt SpeakFlags = C.kNoSpeechInterrupt
+	// SpeakPreflightThenPause processes the text up to the point where speech can start and then pauses, so that
+	// Continue starts speech without delay.
+	SpeakPreflightThenPause SpeakFlags = C.kPreflightThenPause
+)
+
+// SpeakBuffer is like SpeakString, but passes control flags to the synthesizer.
+func (c *Channel) SpeakBuffer(s string, flags SpeakFlags) error {
+	cfs := cfstring(s)
+	defer C.CFRelease(C.CFTypeRef(cfs))
+	return osError(C.mactts_speak_flags(c.csc, cfs, C.SInt32(flags)))
+}
+
+// textEncoding returns the text encoding of the channel's voice, which is used for text passed to the synthesizer
+// as bytes rather than as a CFString.
+func (c *Channel) textEncoding() (C.CFStringEncoding, error) {
+	vs, err := c.Voice()
+	if err != nil {
+		return 0, err
+	}
+	vd, err := vs.Description()
+	if err != nil {
+		return 0, err
+	}
+	return C.CFStringEncoding(vd.script), nil
+}
+
+// freeBuffer frees a buffer returned by mactts_cfstring_bytes.
+func freeBuffer(buf unsafe.Pointer) {
+	C.free(buf)
+}
+
+// TextToPhonemes converts text to the phonemes the channel would speak for it, in the notation accepted by
+// SpeakPhonemes. The conversion uses the channel's voice and settings, such as its pronunciation dictionaries. The
+// phonemes can be edited and spoken with SpeakPhonemes, or with SpeakString in InputModePhoneme.
+func (c *Channel) TextToPhonemes(text string) (string, error) {
+	cfs := cfstring(text)
+	defer C.CFRelease(C.CFTypeRef(cfs))
+	var phonemes C.CFStringRef
+	if err := osError(C.CopyPhonemesFromText(c.csc, cfs, &phonemes)); err != nil {
+		return "", err
+	}
+	defer C.CFRelease(C.CFTypeRef(phonemes))
+	return cfstringGo(phonemes), nil
+}
+
+// UseDictionary installs a pronunciation dictionary on the channel, given the data of a Speech Manager dictionary
+// resource. The words in the dictionary are spoken as it specifies, overriding earlier dictionaries installed on the
+// channel. If the data is not a valid dictionary, the "pronunciation dictionary format error" is returned.
+func (c *Channel) UseDictionary(dict []byte) error {
+	if len(dict) == 0 {
+		return osErrorMap[C.badDictFormat]
+	}
+	return osError(C.mactts_use_dictionary(c.csc, unsafe.Pointer(&dict[0]), C.long(len(dict))))
+}
+
 // SetRate sets the speech rate in words-per-minute.
 //
 // SetRate adjusts the rate of the speech channel to the rate specified by the rate parameter. As a general rule, speaking rates
@@ -369,6 +1141,27 @@ func (c *Channel) SetRate(rate int) error {
 	return osError(C.SetSpeechRate(c.csc, C.Fixed(rate<<16)))
 }
 
+// GetRate returns the current speech rate of the channel in words per minute, rounded to the nearest word. The
+// synthesizer may have adjusted the rate given to SetRate to fit the range it supports.
+func (c *Channel) GetRate() (int, error) {
+	var rate C.Fixed
+	if err := osError(C.GetSpeechRate(c.csc, &rate)); err != nil {
+		return 0, err
+	}
+	return (int(rate) + 0x8000) >> 16, nil
+}
+
+var errNoDefaultRate = errors.New("default speech rate of the voice is unknown")
+
+// SetRateMultiplier sets the speech rate relative to the default rate of the channel's voice. A factor of 1.5 speaks
+// 50% faster than the voice normally does, and a factor of 1 restores its default rate.
+func (c *Channel) SetRateMultiplier(factor float64) error {
+	if c.defaultRate == 0 {
+		return errNoDefaultRate
+	}
+	return osError(C.SetSpeechRate(c.csc, C.Fixed(float64(c.defaultRate)*factor)))
+}
+
 // SetPitchBase sets the pitch of the speech with frequency mapped as a MIDI note number.
 //
 // SetPitchBase changes the current speech pitch on the speech channel to the pitch specified by the pitch parameter. Typical voice
@@ -381,6 +1174,25 @@ func (c *Channel) SetPitchBase(pitch float64) error {
 	return osError(C.SetSpeechPitch(c.csc, C.Fixed(pitch*65536)))
 }
 
+// GetPitchBase returns the current pitch of the speech as a MIDI note number. The synthesizer may have adjusted the
+// pitch given to SetPitchBase to fit the range it supports.
+func (c *Channel) GetPitchBase() (float64, error) {
+	var pitch C.Fixed
+	if err := osError(C.GetSpeechPitch(c.csc, &pitch)); err != nil {
+		return 0, err
+	}
+	return float64(pitch) / 65536, nil
+}
+
+// GetPitchMod returns the current pitch modulation of the speech, as set by SetPitchMod.
+func (c *Channel) GetPitchMod() (float64, error) {
+	var mod C.double
+	if err := osError(C.mactts_get_property_float64(c.csc, C.kSpeechPitchModProperty, &mod)); err != nil {
+		return 0, err
+	}
+	return float64(mod), nil
+}
+
 // SetPitchMod sets the pitch modulation of the speech with frequency mapped as a MIDI note number.
 //
 // Pitch modulation is valid within the range of 0.000 to 127.000, corresponding to MIDI note values, where 60.000 is equal
@@ -392,6 +1204,16 @@ func (c *Channel) SetPitchMod(mod float64) error {
 	return osError(C.mactts_set_property_float64(c.csc, C.kSpeechPitchModProperty, C.double(mod)))
 }
 
+// GetVolume returns the current speech channel volume, from 0.0 through 1.0. The synthesizer may have adjusted the
+// volume given to SetVolume to fit the range it supports.
+func (c *Channel) GetVolume() (float64, error) {
+	var volume C.double
+	if err := osError(C.mactts_get_property_float64(c.csc, C.kSpeechVolumeProperty, &volume)); err != nil {
+		return 0, err
+	}
+	return float64(volume), nil
+}
+
 // SetVolume sets the speech channel volume.
 //
 // Speech volumes are expressed in values ranging from 0.0 through 1.0. A value of 0.0 corresponds to silence, and a value of 1.0
@@ -401,13 +1223,204 @@ func (c *Channel) SetVolume(volume float64) error {
 	return osError(C.mactts_set_property_float64(c.csc, C.kSpeechVolumeProperty, C.double(volume)))
 }
 
+// CharacterMode controls how the synthesizer speaks the characters of words.
+type CharacterMode C.OSType
+
+const (
+	// CharacterModeNormal speaks words as words.
+	CharacterModeNormal CharacterMode = C.modeNormal
+	// CharacterModeLiteral spells out each character of a word.
+	CharacterModeLiteral CharacterMode = C.modeLiteral
+)
+
+// NumberMode controls how the synthesizer speaks numbers.
+type NumberMode C.OSType
+
+const (
+	// NumberModeNormal speaks numbers as values, e.g. 42 as "forty-two".
+	NumberModeNormal NumberMode = C.modeNormal
+	// NumberModeLiteral speaks each digit of a number, e.g. 42 as "four two".
+	NumberModeLiteral NumberMode = C.modeLiteral
+)
+
+// InputMode controls how the synthesizer interprets the text it is given.
+type InputMode C.OSType
+
+const (
+	// InputModeText interprets the input as text.
+	InputModeText InputMode = C.modeText
+	// InputModePhoneme interprets the input as phonemes, in the notation accepted by SpeakPhonemes.
+	InputModePhoneme InputMode = C.modePhonemes
+)
+
+// CharacterMode returns the current character processing mode of the channel.
+func (c *Channel) CharacterMode() (CharacterMode, error) {
+	var mode C.OSType
+	err := osError(C.GetSpeechInfo(c.csc, C.soCharacterMode, unsafe.Pointer(&mode)))
+	return CharacterMode(mode), err
+}
+
+// SetCharacterMode sets the character processing mode of the channel, so that text such as serial numbers can be
+// spelled out with CharacterModeLiteral and prose spoken again with CharacterModeNormal.
+func (c *Channel) SetCharacterMode(mode CharacterMode) error {
+	m := C.OSType(mode)
+	return osError(C.SetSpeechInfo(c.csc, C.soCharacterMode, unsafe.Pointer(&m)))
+}
+
+// NumberMode returns the current number processing mode of the channel.
+func (c *Channel) NumberMode() (NumberMode, error) {
+	var mode C.OSType
+	err := osError(C.GetSpeechInfo(c.csc, C.soNumberMode, unsafe.Pointer(&mode)))
+	return NumberMode(mode), err
+}
+
+// SetNumberMode sets the number processing mode of the channel, so that numbers such as phone numbers can be read
+// digit by digit with NumberModeLiteral.
+func (c *Channel) SetNumberMode(mode NumberMode) error {
+	m := C.OSType(mode)
+	return osError(C.SetSpeechInfo(c.csc, C.soNumberMode, unsafe.Pointer(&m)))
+}
+
+// InputMode returns the current input mode of the channel.
+func (c *Channel) InputMode() (InputMode, error) {
+	var mode C.OSType
+	err := osError(C.GetSpeechInfo(c.csc, C.soInputMode, unsafe.Pointer(&mode)))
+	return InputMode(mode), err
+}
+
+// SetInputMode sets the input mode of the channel. In InputModePhoneme, the text passed to SpeakString is spoken as
+// phonemes, and phonemes the synthesizer cannot parse are reported to the callback set with SetErrorCallback as a
+// "raw phoneme text contains invalid characters" error. SpeakPhonemes switches the input mode for the phonemes it speaks and back again, and reports
+// the position of invalid phonemes itself.
+func (c *Channel) SetInputMode(mode InputMode) error {
+	m := C.OSType(mode)
+	return osError(C.SetSpeechInfo(c.csc, C.soInputMode, unsafe.Pointer(&m)))
+}
+
+var errBadDelimiter = errors.New("command delimiters must be one or two characters")
+
+// SetCommandDelimiters sets the delimiters that mark commands embedded in the text spoken by the channel, which are
+// [[ and ]] by default. Delimiters that cannot occur in the text keep brackets in it from being taken as commands.
+// Each delimiter must be one or two characters.
+func (c *Channel) SetCommandDelimiters(begin, end string) error {
+	for _, d := range []string{begin, end} {
+		if n := utf8.RuneCountInString(d); n < 1 || n > 2 {
+			return errBadDelimiter
+		}
+	}
+	prefix, suffix := cfstring(begin), cfstring(end)
+	defer C.CFRelease(C.CFTypeRef(prefix))
+	defer C.CFRelease(C.CFTypeRef(suffix))
+	return osError(C.mactts_set_command_delimiters(c.csc, prefix, suffix))
+}
+
+// DisableCommands turns off the processing of embedded commands on the channel, so that all text is spoken literally,
+// as is needed for untrusted text. This also prevents changes of rate, pitch and volume with embedded commands, such
+// as those made by ProsodyScript, and stops SpeakPhonemes from working; the Set methods of the channel still work.
+// SetCommandDelimiters turns command processing back on.
+func (c *Channel) DisableCommands() error {
+	// delimiters of NUL characters disable command processing
+	var d C.DelimiterInfo
+	return osError(C.SetSpeechInfo(c.csc, C.soCommandDelimiter, unsafe.Pointer(&d)))
+}
+
+// Voice returns the voice currently used by the channel. The VoiceSpec is a full voice specifier that can be passed
+// to Description and Attributes, or compared with the voice wanted for a channel taken from a pool before calling
+// SetVoice.
+func (c *Channel) Voice() (vs VoiceSpec, err error) {
+	err = osError(C.mactts_get_current_voice(c.csc, (*C.VoiceSpec)(&vs)))
+	return
+}
+
+// SetVoice changes the voice of the channel to vs, so a channel can be reused for another voice instead of being
+// closed and replaced. The rate, pitch and other settings of the channel are reset to the defaults of the new voice.
+// If the synthesizer of the channel cannot use the voice, the "specified voice cannot be used with synthesizer" error
+// is returned.
+func (c *Channel) SetVoice(vs *VoiceSpec) error {
+	if err := osError(C.SetSpeechInfo(c.csc, C.soCurrentVoice, unsafe.Pointer(vs))); err != nil {
+		return err
+	}
+	// the default rate of the new voice is the base of SetRateMultiplier
+	c.defaultRate = 0
+	C.GetSpeechRate(c.csc, &c.defaultRate)
+	// continuation text must be in the encoding of the new voice
+	if c.textDoneCb != nil {
+		enc, err := c.textEncoding()
+		if err != nil {
+			return err
+		}
+		c.textDoneEnc = enc
+	}
+	return nil
+}
+
 // SetExtAudioFile sets the channel's output destination to an extended audio file, or back to the speakers, if eaf is nil.
+// Any PCMSink previously set with SetPCMSink is closed.
 func (c *Channel) SetExtAudioFile(eaf *ExtAudioFile) error {
 	var cref unsafe.Pointer
 	if eaf != nil {
 		cref = unsafe.Pointer(eaf.ceaf)
 	}
-	return osError(C.mactts_set_property_ptr(c.csc, C.kSpeechOutputToExtAudioFileProperty, cref))
+	if err := osError(C.mactts_set_property_ptr(c.csc, C.kSpeechOutputToExtAudioFileProperty, cref)); err != nil {
+		return err
+	}
+	if out := c.pcmOut; out != nil {
+		c.pcmOut = nil
+		return out.close()
+	}
+	return nil
+}
+
+// status returns the current status of the channel.
+func (c *Channel) status() (info C.SpeechStatusInfo, err error) {
+	err = osError(C.GetSpeechInfo(c.csc, C.soStatus, unsafe.Pointer(&info)))
+	return
+}
+
+// SpeechStatus is the synthesis status of a channel.
+type SpeechStatus struct {
+	OutputBusy     bool        // the channel is producing speech
+	OutputPaused   bool        // speech has been paused with Pause
+	CharactersLeft int         // bytes of the input text still to be processed
+	PhonemeCode    PhonemeCode // the phoneme being spoken
+}
+
+// Status returns the synthesis status of the channel. CharactersLeft falls to zero as the synthesizer works through
+// the text, so it can be compared with the length of the text to report progress.
+func (c *Channel) Status() (SpeechStatus, error) {
+	info, err := c.status()
+	if err != nil {
+		return SpeechStatus{}, err
+	}
+	return SpeechStatus{
+		OutputBusy:     info.outputBusy != 0,
+		OutputPaused:   info.outputPaused != 0,
+		CharactersLeft: int(info.inputBytesLeft),
+		PhonemeCode:    PhonemeCode(info.phonemeCode),
+	}, nil
+}
+
+// IsSpeaking reports whether the channel is producing speech. It can be polled to wait for synthesis to complete
+// without a done callback, which is called on a synthesizer thread.
+func (c *Channel) IsSpeaking() (bool, error) {
+	info, err := c.status()
+	return info.outputBusy != 0, err
+}
+
+// RecentSync returns the message of the most recent synchronization command the synthesizer reached on the channel,
+// as passed to the callback set with SetSyncCallback, or 0 if it has not reached one.
+func (c *Channel) RecentSync() (int32, error) {
+	var msg C.OSType
+	err := osError(C.GetSpeechInfo(c.csc, C.soRecentSync, unsafe.Pointer(&msg)))
+	return int32(msg), err
+}
+
+// Busy reports whether the channel is in use: producing speech, or paused with text still to speak. Unlike the
+// package level Busy, which reports whether any channel of the process is processing speech, it only looks at this
+// channel, so an idle channel can be picked from several.
+func (c *Channel) Busy() (bool, error) {
+	info, err := c.status()
+	return info.outputBusy != 0 || (info.outputPaused != 0 && info.inputBytesLeft > 0), err
 }
 
 // Stop terminates speech generation on the channel immediately.
@@ -417,13 +1430,140 @@ func (c *Channel) Stop() error {
 	return osError(C.StopSpeech(c.csc))
 }
 
+// FlushQueue discards all speech queued on the channel, allowing the sentence currently being spoken to finish.
+//
+// Unlike Stop, FlushQueue avoids cutting off the current utterance mid-word. Like Stop, it can be called on an idle
+// channel without ill effect.
+func (c *Channel) FlushQueue() error {
+	return osError(C.StopSpeechAt(c.csc, C.kEndOfSentence))
+}
+
+// PauseWhere is where in the speech Pause takes effect.
+type PauseWhere C.SInt32
+
+const (
+	// PauseImmediate pauses speech at once, possibly mid-word.
+	PauseImmediate PauseWhere = C.kImmediate
+	// PauseEndOfWord pauses speech at the end of the current word.
+	PauseEndOfWord PauseWhere = C.kEndOfWord
+	// PauseEndOfSentence pauses speech at the end of the current sentence.
+	PauseEndOfSentence PauseWhere = C.kEndOfSentence
+)
+
+// Pause pauses speech on the channel at the given point. Speech resumes where it paused when Continue is called.
+//
+// Like Stop, Pause can be called on an idle channel without ill effect.
+func (c *Channel) Pause(where PauseWhere) error {
+	return osError(C.PauseSpeechAt(c.csc, C.SInt32(where)))
+}
+
+// Continue resumes speech paused with Pause.
+func (c *Channel) Continue() error {
+	return osError(C.ContinueSpeech(c.csc))
+}
+
+// ID returns a value identifying the channel for as long as it is open, for correlating log messages from callbacks
+// with the channel that made them. For channels made with NewChannel, it is the reference constant the synthesizer
+// passes to the callbacks.
+func (c *Channel) ID() uintptr {
+	return uintptr(unsafe.Pointer(c))
+}
+
 // Close closes the synthesizer speech channel and releases all internal resources.
 func (c *Channel) Close() {
+	if c.csc != nil {
+		atomic.AddInt64(&liveChannels, -1)
+	}
 	disposeSpeechChannel(c)
 	runtime.SetFinalizer(c, nil)
 }
 
-// Busy indicates whether any speech channels are currently processing speech.
+// maxChannelProbe bounds the number of speech channels MaxChannels opens.
+const maxChannelProbe = 256
+
+// MaxChannels determines how many speech channels can be open at once by opening channels with the system voice until
+// the synthesizer refuses to open another, and then disposing of them. The result is capped at 256.
+//
+// Channels that are already open count against the limit, so MaxChannels is best called at startup.
+func MaxChannels() (int, error) {
+	chans := make([]C.SpeechChannel, 0, 16)
+	defer func() {
+		for _, csc := range chans {
+			C.DisposeSpeechChannel(csc)
+		}
+	}()
+	for len(chans) < maxChannelProbe {
+		var csc C.SpeechChannel
+		oserr := C.NewSpeechChannel(nil, &csc)
+		if oserr == C.synthOpenFailed {
+			break
+		} else if oserr != 0 {
+			return len(chans), osError(oserr)
+		}
+		chans = append(chans, csc)
+	}
+	return len(chans), nil
+}
+
+var errNoVoices = errors.New("no voices are installed")
+
+// Probe checks that the speech synthesizer is working by counting the installed voices and opening and disposing of a
+// speech channel with the system voice.
+//
+// The Speech Synthesis Manager cannot be reinitialized within a process. If Probe keeps failing, the synthesizer is
+// wedged and the only way to recover is to restart the process.
+func Probe() error {
+	n, err := NumVoices()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNoVoices
+	}
+	var csc C.SpeechChannel
+	if oserr := C.NewSpeechChannel(nil, &csc); oserr != 0 {
+		return osError(oserr)
+	}
+	return osError(C.DisposeSpeechChannel(csc))
+}
+
+// TextToPhonemes converts text to the phonemes the voice vs, or the system voice if vs is nil, would speak for it,
+// without the caller needing a channel.
+func TextToPhonemes(vs *VoiceSpec, text string) (string, error) {
+	c, err := NewQueryChannel(vs)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	return c.TextToPhonemes(text)
+}
+
+// SynthesizerInfo returns the identifier and version of the synthesizer that provides a voice, or of the synthesizer
+// of the system voice if vs is nil. Either string is empty if the synthesizer does not report it.
+func SynthesizerInfo(vs *VoiceSpec) (creator, version string, err error) {
+	c, err := NewQueryChannel(vs)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	var dict C.CFDictionaryRef
+	var ident, vers C.CFStringRef
+	if err = osError(C.mactts_get_synth_info(c.csc, &dict, &ident, &vers)); err != nil {
+		return
+	}
+	defer C.CFRelease(C.CFTypeRef(dict))
+	if C.mactts_cfstring_valid(ident) != 0 {
+		creator = cfstringGo(ident)
+	}
+	if C.mactts_cfstring_valid(vers) != 0 {
+		version = cfstringGo(vers)
+	}
+	return
+}
+
+// Busy indicates whether any speech channels are currently processing speech. Use the Busy method of a Channel to
+// check a single channel.
 func Busy() bool {
 	return C.SpeechBusy() != 0
 }
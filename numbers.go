@@ -0,0 +1,156 @@
+package mactts
+
+import "strings"
+
+// The functions in this file spell out numbers as English words, so that they are read the same way by every voice
+// regardless of how its synthesizer interprets digits and symbols.
+
+var smallNumbers = []string{
+	"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten",
+	"eleven", "twelve", "thirteen", "fourteen", "fifteen", "sixteen", "seventeen", "eighteen", "nineteen",
+}
+
+var tensNumbers = []string{"", "", "twenty", "thirty", "forty", "fifty", "sixty", "seventy", "eighty", "ninety"}
+
+var scaleNumbers = []struct {
+	value uint64
+	name  string
+}{
+	{1e18, "quintillion"},
+	{1e15, "quadrillion"},
+	{1e12, "trillion"},
+	{1e9, "billion"},
+	{1e6, "million"},
+	{1e3, "thousand"},
+}
+
+var irregularOrdinals = map[string]string{
+	"one":    "first",
+	"two":    "second",
+	"three":  "third",
+	"five":   "fifth",
+	"eight":  "eighth",
+	"nine":   "ninth",
+	"twelve": "twelfth",
+}
+
+func spellCardinal(n uint64) string {
+	if n < 20 {
+		return smallNumbers[n]
+	}
+	var words []string
+	for _, sc := range scaleNumbers {
+		if n >= sc.value {
+			words = append(words, spellCardinal(n/sc.value), sc.name)
+			n %= sc.value
+		}
+	}
+	if n >= 100 {
+		words = append(words, smallNumbers[n/100], "hundred")
+		n %= 100
+	}
+	if n >= 20 && n%10 != 0 {
+		words = append(words, tensNumbers[n/10]+"-"+smallNumbers[n%10])
+	} else if n >= 20 {
+		words = append(words, tensNumbers[n/10])
+	} else if n > 0 {
+		words = append(words, smallNumbers[n])
+	}
+	return strings.Join(words, " ")
+}
+
+// CardinalText returns n spelled out in words, e.g. "one hundred twenty-three" for 123.
+func CardinalText(n int64) string {
+	if n < 0 {
+		return "minus " + spellCardinal(uint64(-(n+1))+1)
+	}
+	return spellCardinal(uint64(n))
+}
+
+// OrdinalText returns the ordinal of n spelled out in words, e.g. "twenty-first" for 21.
+func OrdinalText(n int64) string {
+	c := CardinalText(n)
+	i := strings.LastIndexAny(c, " -") + 1
+	w := c[i:]
+	if o, ok := irregularOrdinals[w]; ok {
+		w = o
+	} else if strings.HasSuffix(w, "y") {
+		w = w[:len(w)-1] + "ieth"
+	} else {
+		w += "th"
+	}
+	return c[:i] + w
+}
+
+// FractionText returns the fraction num/den spelled out in words, e.g. "one half" for 1/2 or "three quarters"
+// for 3/4.
+func FractionText(num, den int64) string {
+	if den < 0 {
+		num, den = -num, -den
+	}
+	switch den {
+	case 0:
+		return CardinalText(num) + " over zero"
+	case 1:
+		return CardinalText(num)
+	}
+	singular := num == 1 || num == -1
+	var d string
+	switch {
+	case den == 2 && singular:
+		d = "half"
+	case den == 2:
+		d = "halves"
+	case den == 4 && singular:
+		d = "quarter"
+	case den == 4:
+		d = "quarters"
+	case singular:
+		d = OrdinalText(den)
+	default:
+		d = OrdinalText(den) + "s"
+	}
+	return CardinalText(num) + " " + d
+}
+
+// Currency names a monetary unit and its hundredth part in singular and plural forms.
+type Currency struct {
+	Unit, Units       string
+	Subunit, Subunits string
+}
+
+// USDollar is the currency of the United States.
+var USDollar = Currency{"dollar", "dollars", "cent", "cents"}
+
+// Text returns amount, given in hundredths of the unit, spelled out in words, e.g. "three dollars and five cents"
+// for 305.
+func (cur Currency) Text(amount int64) string {
+	var sign string
+	if amount < 0 {
+		sign = "minus "
+	}
+	units, subunits := amount/100, amount%100
+	if units < 0 {
+		units = -units
+	}
+	if subunits < 0 {
+		subunits = -subunits
+	}
+
+	var words []string
+	if units != 0 || subunits == 0 {
+		name := cur.Units
+		if units == 1 {
+			name = cur.Unit
+		}
+		words = append(words, CardinalText(units)+" "+name)
+	}
+	if subunits != 0 {
+		name := cur.Subunits
+		if subunits == 1 {
+			name = cur.Subunit
+		}
+		words = append(words, CardinalText(subunits)+" "+name)
+	}
+	return sign + strings.Join(words, " and ")
+}
@@ -0,0 +1,172 @@
+package mactts
+
+import "errors"
+import "io"
+import "math"
+
+// PCMSink receives synthesized audio as linear PCM, so that it can be encoded to formats that CoreAudio does not
+// support, such as Opus, outside of this package.
+//
+// The audio passed to WritePCM is mono 16-bit signed little-endian samples. The buffer is owned by CoreAudio and must
+// not be retained after WritePCM returns.
+type PCMSink interface {
+	WritePCM(p []byte) error
+	Close() error
+}
+
+var (
+	errPCMOrder  = errors.New("PCM data was not written sequentially")
+	errPCMUnread = errors.New("PCM data passed to a sink cannot be read back")
+)
+
+// pcmTarget is a ReadWriterAt for an audio file that keeps the header in memory and passes the audio data to a PCMSink as
+// it is written. The audio data must be written sequentially. If withHeader is set, the header as it stands when the
+// first audio data is written is passed to the sink ahead of the data, so the sink receives a whole file.
+type pcmTarget struct {
+	sink       PCMSink
+	dataOffset int64 // math.MaxInt64 until the file has been initialized
+	next       int64 // offset of the next audio data write
+	header     []byte
+	withHeader bool
+	headerSent bool
+}
+
+// sendHeader passes the header to the sink if withHeader is set and it has not been sent yet.
+func (t *pcmTarget) sendHeader() error {
+	if !t.withHeader || t.headerSent {
+		return nil
+	}
+	if n := t.dataOffset - int64(len(t.header)); n > 0 && t.dataOffset != math.MaxInt64 {
+		t.header = append(t.header, make([]byte, n)...)
+	}
+	t.headerSent = true
+	return t.sink.WritePCM(t.header)
+}
+
+func (t *pcmTarget) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > t.dataOffset {
+		return 0, errPCMUnread
+	}
+	if off >= int64(len(t.header)) {
+		return 0, io.EOF
+	}
+	n := copy(p, t.header[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (t *pcmTarget) WriteAt(p []byte, off int64) (int, error) {
+	n := len(p)
+	if off < t.dataOffset {
+		h := p
+		if int64(len(h)) > t.dataOffset-off {
+			h = h[:t.dataOffset-off]
+		}
+		if end := off + int64(len(h)); end > int64(len(t.header)) {
+			t.header = append(t.header, make([]byte, end-int64(len(t.header)))...)
+		}
+		copy(t.header[off:], h)
+		p = p[len(h):]
+		off += int64(len(h))
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+	if off-t.dataOffset != t.next {
+		return 0, errPCMOrder
+	}
+	if err := t.sendHeader(); err != nil {
+		return 0, err
+	}
+	if err := t.sink.WritePCM(p); err != nil {
+		return 0, err
+	}
+	t.next += int64(len(p))
+	return n, nil
+}
+
+// pcmOutput is the output file of a channel writing to a PCMSink.
+type pcmOutput struct {
+	af   *AudioFile
+	eaf  *ExtAudioFile
+	sink PCMSink
+}
+
+func (o *pcmOutput) close() error {
+	o.eaf.Close()
+	o.af.Close()
+	return o.sink.Close()
+}
+
+// SetPCMSink sets the channel's output destination to sink, which receives the audio at the given sample rate, or back
+// to the speakers, if sink is nil. The sink is closed when the output destination of the channel is changed again or
+// the channel is closed.
+func (c *Channel) SetPCMSink(sink PCMSink, rate float64) error {
+	if sink == nil {
+		return c.SetExtAudioFile(nil)
+	}
+	return c.setSinkOutput(sink, func(t ReadWriterAt) (*AudioFile, error) {
+		return NewOutputWAVEFile(t, rate, 1, 16)
+	})
+}
+
+// writerSink is a PCMSink writing to an io.Writer, which it does not close.
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) WritePCM(p []byte) error {
+	_, err := s.w.Write(p)
+	return err
+}
+
+func (s writerSink) Close() error {
+	return nil
+}
+
+var errOutputFormat = errors.New("output writer format must be linear PCM")
+
+// SetOutputWriter sets the channel's output destination to w, which receives the audio as raw linear PCM samples in
+// the given format as they are synthesized, or back to the speakers, if w is nil. Unlike output to an audio file, the
+// audio is not held in memory, so it can be streamed, for example in a chunked HTTP response. w is not closed.
+func (c *Channel) SetOutputWriter(w io.Writer, format StreamFormat) error {
+	if w == nil {
+		return c.SetExtAudioFile(nil)
+	}
+	if format.FormatID != FormatLinearPCM {
+		return errOutputFormat
+	}
+	// CAF files can hold linear PCM of either byte order, and only the audio data reaches w
+	return c.setSinkOutput(writerSink{w}, func(t ReadWriterAt) (*AudioFile, error) {
+		return NewOutputFileWithFormat(t, AudioFileCAF, format)
+	})
+}
+
+// setSinkOutput sets the channel's output destination to an audio file opened by open, with the audio data passed to
+// sink.
+func (c *Channel) setSinkOutput(sink PCMSink, open func(ReadWriterAt) (*AudioFile, error)) error {
+	t := &pcmTarget{sink: sink, dataOffset: math.MaxInt64}
+	af, err := open(t)
+	if err != nil {
+		return err
+	}
+	t.dataOffset = af.dataOffset
+	if t.dataOffset == math.MaxInt64 {
+		af.Close()
+		return errors.New("cannot determine the audio data offset of the PCM output")
+	}
+	eaf, err := af.ExtAudioFile()
+	if err != nil {
+		af.Close()
+		return err
+	}
+	if err = c.SetExtAudioFile(eaf); err != nil {
+		eaf.Close()
+		af.Close()
+		return err
+	}
+	c.pcmOut = &pcmOutput{af: af, eaf: eaf, sink: sink}
+	return nil
+}
@@ -0,0 +1,367 @@
+package mactts
+
+import "bufio"
+import "bytes"
+import "context"
+import "fmt"
+import "io"
+import "os"
+import "strings"
+import "time"
+import "unicode/utf8"
+
+// maxChunk bounds the length of the text SpeakReader passes to the synthesizer at once.
+const maxChunk = 4096
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+// scanSentences is a bufio.SplitFunc that splits text after sentence ending punctuation that is followed by white
+// space, and after line breaks. Text without a sentence break is split into chunks of at most maxChunk bytes.
+func scanSentences(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i := 0; i < len(data) && i < maxChunk; i++ {
+		switch data[i] {
+		case '\n':
+			return i + 1, data[:i+1], nil
+		case '.', '!', '?':
+			if i+1 < len(data) && isSpace(data[i+1]) {
+				return i + 2, data[:i+2], nil
+			}
+		}
+	}
+	if len(data) >= maxChunk {
+		// break at the last space, or failing that at the last rune boundary
+		i := bytes.LastIndexAny(data[:maxChunk], " \t\r")
+		if i <= 0 {
+			i = maxChunk
+			for i > 0 && i < len(data) && !utf8.RuneStart(data[i]) {
+				i--
+			}
+			if i == 0 {
+				i = maxChunk
+			}
+		}
+		return i, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// speakWait speaks text and waits until it has been spoken or ctx is done, in which case speech is stopped and
+// ctx.Err() is returned. If flags is not zero, the text is spoken with SpeakBuffer and the flags. The done callback of
+// the channel is replaced while speaking.
+func (c *Channel) speakWait(ctx context.Context, text string, flags SpeakFlags) error {
+	done := make(chan struct{}, 1)
+	prev := c.done
+	err := c.SetDone(func() {
+		select {
+		case done <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer c.SetDone(prev)
+
+	if flags == 0 {
+		err = c.SpeakString(text)
+	} else {
+		err = c.SpeakBuffer(text, flags)
+	}
+	if err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		c.Stop()
+		return ctx.Err()
+	}
+}
+
+// SpeakStringContext speaks text and waits until it has been spoken or ctx is done, in which case speech is stopped
+// and ctx.Err() is returned.
+//
+// The done callback of the channel is replaced while SpeakStringContext runs.
+func (c *Channel) SpeakStringContext(ctx context.Context, text string) error {
+	return c.speakWait(ctx, text, 0)
+}
+
+// SpeakAndWait speaks text and waits until it has been spoken, stopping speech and returning
+// context.DeadlineExceeded if that takes longer than timeout. It is the usual way to synthesize an utterance to a file
+// set with SetExtAudioFile.
+//
+// The done callback of the channel is replaced while SpeakAndWait runs.
+func (c *Channel) SpeakAndWait(text string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.speakWait(ctx, text, 0)
+}
+
+// SpeakReader speaks the text read from r a sentence at a time, waiting for each sentence to be spoken before reading
+// more. If ctx is done, speech is stopped, no more of r is read, and ctx.Err() is returned.
+//
+// The done callback of the channel is replaced while SpeakReader runs.
+func (c *Channel) SpeakReader(ctx context.Context, r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Split(scanSentences)
+	for sc.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		text := sc.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if err := c.speakWait(ctx, text, 0); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// SpeakFile is like SpeakReader, but speaks the UTF-8 text in the named file.
+func (c *Channel) SpeakFile(ctx context.Context, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.SpeakReader(ctx, f)
+}
+
+// WordTiming is the position of a spoken word in synthesized audio.
+type WordTiming struct {
+	Word                 string
+	Offset               int   // byte offset of the word in the text
+	StartFrame, EndFrame int64 // in frames at the sample rate of the client data format
+}
+
+// SpeakTimings speaks text to eaf, which must be the output file of the channel set with SetExtAudioFile, and waits
+// until it has been spoken or ctx is done. It returns the position in sample frames of each word in the audio. A word
+// starts at the frame written when the synthesizer reaches it, and ends where the next word starts, or at the end of
+// the audio for the last word.
+//
+// Frames are counted by eaf.Tell, at the sample rate of eaf.ClientDataFormat, which is the native rate of the voice and
+// may differ from the sample rate of the file.
+//
+// The done and word callbacks of the channel are replaced while SpeakTimings runs.
+func (c *Channel) SpeakTimings(ctx context.Context, text string, eaf *ExtAudioFile) ([]WordTiming, error) {
+	var words []WordTiming
+	prev := c.wordCb
+	err := c.setWordCb(func(offset, length int) {
+		if offset+length > len(text) {
+			return
+		}
+		start, _ := eaf.Tell()
+		words = append(words, WordTiming{Word: text[offset : offset+length], Offset: offset, StartFrame: start})
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.setWordCb(prev)
+
+	if err = c.speakWait(ctx, text, 0); err != nil {
+		return nil, err
+	}
+	end, err := eaf.Tell()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(words) - 1; i >= 0; i-- {
+		words[i].EndFrame = end
+		end = words[i].StartFrame
+	}
+	return words, nil
+}
+
+// SpeakMarkers speaks text to eaf, which must be the output file of the channel set with SetExtAudioFile, and waits
+// until it has been spoken or ctx is done. A Marker is recorded at the frame written when the synthesizer reaches each
+// embedded sync command, such as [[sync 0x1A2B3C4D]], and the markers are stored in the audio file of eaf with
+// AudioFile.SetMarkers, so that a WAVE file gets a cue point for each. The markers are numbered from 1 in the order
+// they are reached and named after the message of their command. They are also returned.
+//
+// The synthesizer counts frames at the sample rate of the client data format, so marker positions are converted to
+// the sample rate of the file. Sync commands are only reached if the channel interprets embedded commands. The done and
+// sync callbacks of the channel are replaced while SpeakMarkers runs.
+func (c *Channel) SpeakMarkers(ctx context.Context, text string, eaf *ExtAudioFile) ([]Marker, error) {
+	var frames []int64
+	var msgs []int32
+	prev := c.syncCb
+	err := c.SetSyncCallback(func(msg int32) {
+		n, _ := eaf.Tell()
+		frames = append(frames, n)
+		msgs = append(msgs, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.SetSyncCallback(prev)
+
+	if err = c.speakWait(ctx, text, 0); err != nil {
+		return nil, err
+	}
+	cf, err := eaf.ClientDataFormat()
+	if err != nil {
+		return nil, err
+	}
+	scale := 1.0
+	if rate := eaf.af.Format().SampleRate; cf.SampleRate != 0 && rate != 0 {
+		scale = rate / cf.SampleRate
+	}
+	markers := make([]Marker, len(frames))
+	for i := range markers {
+		name := fmt.Sprintf("sync 0x%08X", uint32(msgs[i]))
+		markers[i] = Marker{ID: int32(i + 1), Name: name, Frame: int64(float64(frames[i]) * scale)}
+	}
+	if err = eaf.af.SetMarkers(markers); err != nil {
+		return nil, err
+	}
+	return markers, nil
+}
+
+// nativeProbeText is spoken by NativeFormat to find the format of a voice.
+const nativeProbeText = "a"
+
+// NativeFormat returns the format in which the channel's voice synthesizes audio, before it is converted to the
+// format of an output file. There is no property for it, so it is found by speaking a short text to a scratch file and
+// reading the client data format the synthesizer sets, and NativeFormat must not be called while the channel is
+// speaking. The output of the channel is set back to the speakers afterwards, and its done callback is replaced.
+//
+// Setting the native format as the client data format of an output file, before speaking to it, checks that the file
+// can be written from the voice's audio, resampling it if the sample rates differ.
+func (c *Channel) NativeFormat(ctx context.Context) (StreamFormat, error) {
+	var f memFile
+	af, err := NewOutputWAVEFile(&f, 22050, 1, 16)
+	if err != nil {
+		return StreamFormat{}, err
+	}
+	defer af.Close()
+	eaf, err := af.ExtAudioFile()
+	if err != nil {
+		return StreamFormat{}, err
+	}
+	defer eaf.Close()
+	if err = c.SetExtAudioFile(eaf); err != nil {
+		return StreamFormat{}, err
+	}
+	defer c.SetExtAudioFile(nil)
+
+	if err = c.speakWait(ctx, nativeProbeText, 0); err != nil {
+		return StreamFormat{}, err
+	}
+	if err = eaf.CheckAudio(); err != nil {
+		return StreamFormat{}, err
+	}
+	return eaf.ClientDataFormat()
+}
+
+// phonemePrefix and phonemeSuffix switch the synthesizer into and back out of phoneme input mode.
+const (
+	phonemePrefix = "[[inpt PHON]]"
+	phonemeSuffix = "[[inpt TEXT]]"
+)
+
+// PhonemeError reports invalid phoneme syntax in the input to SpeakPhonemes or Dictionary.AddEntry.
+type PhonemeError struct {
+	Pos int // byte offset of the error in the phonemes
+}
+
+func (e *PhonemeError) Error() string {
+	return fmt.Sprintf("invalid phoneme syntax at position %d", e.Pos)
+}
+
+// SpeakPhonemes speaks phonemes given in the synthesizer's phonemic notation and waits until they have been spoken or
+// ctx is done, in which case speech is stopped and ctx.Err() is returned.
+//
+// For the American English voices, phonemes are written as two letter symbols such as AE and IY, which can be mixed
+// with one letter consonants. A stress marker precedes a vowel: 1 for primary stress and 2 for secondary stress, as in
+// "1AEpAXl". A = marks a syllable boundary, % a silence and @ a breath, and spaces separate words. The prominence of a
+// word can be set with ~ (unstressed), _ (normal) or + (emphasized) before it. If the synthesizer cannot parse the
+// phonemes, a *PhonemeError with the position of the problem is returned.
+//
+// The done callback of the channel is replaced while SpeakPhonemes runs.
+func (c *Channel) SpeakPhonemes(ctx context.Context, phonemes string) error {
+	// discard errors from earlier speech, so that only errors in the phonemes are reported
+	if _, _, _, err := c.speechErrors(); err != nil {
+		return err
+	}
+	err := c.speakWait(ctx, phonemePrefix+phonemes+phonemeSuffix, 0)
+	if err != nil && err != osErrorMap[errBadPhonemeText] {
+		return err
+	}
+	count, newest, pos, qerr := c.speechErrors()
+	if qerr != nil {
+		return qerr
+	}
+	if err == nil && (count == 0 || newest != errBadPhonemeText) {
+		return nil
+	}
+	if pos -= len(phonemePrefix); pos < 0 {
+		pos = 0
+	}
+	return &PhonemeError{Pos: pos}
+}
+
+// SpeakLongToFile speaks long text to a new audio file of the given type written to out, as 22,050 Hz mono audio.
+//
+// The text is synthesized a sentence at a time, which keeps memory use down for book length text. Every sentence but
+// the last is spoken without the falling pitch that ends an utterance, so the sentences join without gaps into one
+// continuous passage. The output destination and done callback of the channel are replaced while SpeakLongToFile
+// runs, and output is set back to the speakers when it returns.
+func (c *Channel) SpeakLongToFile(text string, out ReadWriterAt, format AudioFileType) error {
+	af, err := newOutputFileType(out, format, 22050, 1, 16)
+	if err != nil {
+		return err
+	}
+	defer af.Close()
+
+	eaf, err := af.ExtAudioFile()
+	if err != nil {
+		return err
+	}
+	defer eaf.Close()
+
+	if err = c.SetExtAudioFile(eaf); err != nil {
+		return err
+	}
+	defer c.SetExtAudioFile(nil)
+
+	// each sentence is spoken once the next is found, so that the last can be spoken with ending prosody
+	sc := bufio.NewScanner(strings.NewReader(text))
+	sc.Split(scanSentences)
+	var pending string
+	for sc.Scan() {
+		sentence := sc.Text()
+		if strings.TrimSpace(sentence) == "" {
+			continue
+		}
+		if pending != "" {
+			if err = c.speakWait(context.Background(), pending, SpeakNoEndingProsody); err != nil {
+				return err
+			}
+		}
+		pending = sentence
+	}
+	if err = sc.Err(); err != nil {
+		return err
+	}
+	if pending != "" {
+		if err = c.speakWait(context.Background(), pending, 0); err != nil {
+			return err
+		}
+	}
+
+	if err = c.SetExtAudioFile(nil); err != nil {
+		return err
+	}
+	if err = eaf.Close(); err != nil {
+		return err
+	}
+	return af.Close()
+}
@@ -0,0 +1,76 @@
+package mactts
+
+import "context"
+import "errors"
+import "io"
+import "math"
+
+var errNotStreamable = errors.New("audio file type cannot be streamed")
+
+// audioStream is the reader returned by SpeakReaderStream.
+type audioStream struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+// Close closes the stream and stops synthesis.
+func (s *audioStream) Close() error {
+	err := s.PipeReader.Close()
+	s.cancel()
+	return err
+}
+
+// SpeakReaderStream speaks text with the voice vs in a background goroutine and returns a reader of the audio, a file of
+// type format with 16-bit mono samples at the given sample rate. The synthesizer waits for the audio to be read, and
+// closing the reader stops synthesis. An error during synthesis is returned by Read after the audio written so far.
+//
+// As the file is not seekable, its header is sent before the audio data and so does not record the length of the
+// audio. Most readers of WAVE and CAF files accept this, but some AIFF readers may not. M4A files cannot be streamed.
+func SpeakReaderStream(text string, vs *VoiceSpec, format AudioFileType, rate float64) (io.ReadCloser, error) {
+	if format == AudioFileM4A {
+		return nil, errNotStreamable
+	}
+	c, err := NewChannel(vs)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	t := &pcmTarget{sink: writerSink{pw}, dataOffset: math.MaxInt64, withHeader: true}
+	af, err := newOutputFileType(t, format, rate, 1, 16)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	t.dataOffset = af.dataOffset
+	if t.dataOffset == math.MaxInt64 {
+		af.Close()
+		c.Close()
+		return nil, errNotStreamable
+	}
+	eaf, err := af.ExtAudioFile()
+	if err != nil {
+		af.Close()
+		c.Close()
+		return nil, err
+	}
+	if err = c.SetExtAudioFile(eaf); err != nil {
+		eaf.Close()
+		af.Close()
+		c.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		err := c.speakWait(ctx, text, 0)
+		c.Close()
+		eaf.Close()
+		af.Close()
+		// an empty file still has a header
+		if err == nil {
+			err = t.sendHeader()
+		}
+		pw.CloseWithError(err)
+	}()
+	return &audioStream{PipeReader: pr, cancel: cancel}, nil
+}
@@ -0,0 +1,131 @@
+// Package testutil provides helpers for regression testing speech synthesis, such as detecting changes to the output
+// of a voice across operating system updates.
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/jkl1337/mactts"
+)
+
+// synthTimeout bounds the time SynthesizeToHash waits for synthesis to complete.
+const synthTimeout = 1 * time.Minute
+
+var (
+	errTimeout = errors.New("timed out synthesizing speech")
+	errNoData  = errors.New("synthesized WAVE file has no data chunk")
+)
+
+// buffer is an in-memory mactts.ReadWriterAt.
+type buffer struct {
+	b []byte
+}
+
+func (b *buffer) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *buffer) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(b.b)) {
+		b.b = append(b.b, make([]byte, end-int64(len(b.b)))...)
+	}
+	return copy(b.b[off:], p), nil
+}
+
+// SynthesizeToHash synthesizes text with the voice vs, or the system voice if vs is nil, and returns a hex encoded
+// SHA-256 hash of the audio. The audio is 22,050 Hz 16-bit mono linear PCM, with leading and trailing silence
+// trimmed, so the hash only changes when the speech itself does.
+func SynthesizeToHash(text string, vs *mactts.VoiceSpec) (string, error) {
+	var buf buffer
+	if err := synthesize(&buf, text, vs); err != nil {
+		return "", err
+	}
+	pcm, err := waveData(buf.b)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(trimSilence(pcm))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// synthesize speaks text to a WAVE file written to target.
+func synthesize(target mactts.ReadWriterAt, text string, vs *mactts.VoiceSpec) error {
+	af, err := mactts.NewOutputWAVEFile(target, 22050, 1, 16)
+	if err != nil {
+		return err
+	}
+	defer af.Close()
+
+	eaf, err := af.ExtAudioFile()
+	if err != nil {
+		return err
+	}
+	defer eaf.Close()
+
+	// the channel is closed first, so the files are complete when they are closed
+	c, err := mactts.NewChannel(vs)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err = c.SetExtAudioFile(eaf); err != nil {
+		return err
+	}
+	if err = c.SpeakAndWait(text, synthTimeout); err == context.DeadlineExceeded {
+		return errTimeout
+	} else if err != nil {
+		return err
+	}
+	return eaf.CheckAudio()
+}
+
+// waveData returns the contents of the data chunk of a WAVE file.
+func waveData(wav []byte) ([]byte, error) {
+	if len(wav) < 12 || !bytes.Equal(wav[:4], []byte("RIFF")) || !bytes.Equal(wav[8:12], []byte("WAVE")) {
+		return nil, errors.New("synthesized audio is not a WAVE file")
+	}
+	for p := wav[12:]; len(p) >= 8; {
+		size := int64(binary.LittleEndian.Uint32(p[4:8]))
+		body := p[8:]
+		if size > int64(len(body)) {
+			size = int64(len(body))
+		}
+		if bytes.Equal(p[:4], []byte("data")) {
+			return body[:size], nil
+		}
+		// chunks are padded to an even size
+		next := size + size&1
+		if next > int64(len(body)) {
+			break
+		}
+		p = body[next:]
+	}
+	return nil, errNoData
+}
+
+// trimSilence removes the zero 16-bit samples at the start and end of pcm.
+func trimSilence(pcm []byte) []byte {
+	pcm = pcm[:len(pcm)&^1]
+	for len(pcm) >= 2 && pcm[0] == 0 && pcm[1] == 0 {
+		pcm = pcm[2:]
+	}
+	for len(pcm) >= 2 && pcm[len(pcm)-2] == 0 && pcm[len(pcm)-1] == 0 {
+		pcm = pcm[:len(pcm)-2]
+	}
+	return pcm
+}
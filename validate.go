@@ -0,0 +1,47 @@
+package mactts
+
+import "fmt"
+import "unicode/utf8"
+
+// TextError reports a character that the synthesizer cannot speak reliably.
+type TextError struct {
+	Pos    int    // byte offset of the character in the text
+	Reason string // why the character is a problem
+}
+
+func (e *TextError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Reason, e.Pos)
+}
+
+// TextErrors is the list of problems found by ValidateText, in order of position.
+type TextErrors []*TextError
+
+func (errs TextErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	return fmt.Sprintf("%v (and %d more)", errs[0], len(errs)-1)
+}
+
+// ValidateText checks text for characters that are known to make synthesis fail or produce garbled audio: invalid
+// UTF-8, including encoded surrogate halves, control characters other than tab, line feed and carriage return, and
+// the noncharacters U+FFFE and U+FFFF. If any are found, a TextErrors listing each of them is returned.
+func ValidateText(s string) error {
+	var errs TextErrors
+	for i := 0; i < len(s); {
+		r, n := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && n == 1:
+			errs = append(errs, &TextError{Pos: i, Reason: "invalid UTF-8"})
+		case r < 0x20 && r != '\t' && r != '\n' && r != '\r', r >= 0x7f && r <= 0x9f:
+			errs = append(errs, &TextError{Pos: i, Reason: fmt.Sprintf("control character %U", r)})
+		case r == 0xfffe || r == 0xffff:
+			errs = append(errs, &TextError{Pos: i, Reason: fmt.Sprintf("noncharacter %U", r)})
+		}
+		i += n
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}